@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// The agent is a static sncagent binary on remote, see sncagent.go.
+// If a local one is given by --agent-bin or config "agent", snc checks
+// the remote copy by sha256 once per remote host, and uploads it through
+// a data channel if missing or outdated. Then the agent replaces all the
+// nc pipelines; if the upload fails, snc falls back to them.
+
+type agentCache struct {
+	mu      sync.Mutex
+	remote  map[string]bool         // remote host -> agent available
+	uploads map[string]*agentUpload // remote host -> check or upload in progress
+}
+
+// agentUpload is a check or upload in progress, which the others of the
+// same remote wait for, while other remotes go on in parallel.
+type agentUpload struct {
+	done chan struct{}
+	ok   bool
+}
+
+// errAgentUnusable marks the failures that trying again does not fix,
+// which are kept as the agent unavailable on that remote.
+var errAgentUnusable = errors.New("sncagent unusable")
+
+// localAgent returns the local sncagent binary path, empty if not given.
+func localAgent() string {
+	if Options.AgentBin != "" {
+		return Options.AgentBin
+	}
+	return Conf.Path(Conf.Agent)
+}
+
+// Agent reports whether sncagent is available on remote, uploads it if needed.
+func (client *SSHClient) Agent(remote string) bool {
+	bin := localAgent()
+	if bin == "" {
+		return false
+	}
+	if _, ok := client.bastion.(*Direct); ok {
+		return false // ssh channels do all it does
+	}
+
+	ac := &client.agents
+	ac.mu.Lock()
+	if ok, checked := ac.remote[remote]; checked {
+		ac.mu.Unlock()
+		return ok
+	}
+	if u := ac.uploads[remote]; u != nil {
+		ac.mu.Unlock()
+		<-u.done
+		return u.ok
+	}
+	u := &agentUpload{done: make(chan struct{})}
+	if ac.uploads == nil {
+		ac.uploads = make(map[string]*agentUpload)
+	}
+	ac.uploads[remote] = u
+	ac.mu.Unlock()
+
+	err := client.bootstrapAgent(remote, bin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sncagent on %q unavailable, fall back to nc: %v\n", remote, err)
+	}
+	u.ok = err == nil
+
+	ac.mu.Lock()
+	delete(ac.uploads, remote)
+	if err == nil || errors.Is(err, errAgentUnusable) {
+		if ac.remote == nil {
+			ac.remote = make(map[string]bool)
+		}
+		ac.remote[remote] = u.ok
+	}
+	ac.mu.Unlock()
+	close(u.done)
+	return u.ok
+}
+
+func (client *SSHClient) bootstrapAgent(remote, bin string) error {
+	data, err := os.ReadFile(bin)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	localSum := hex.EncodeToString(sum[:])
+
+	ss, err := client.Session(remote)
+	if err != nil {
+		return err
+	}
+	defer closeSession(ss)
+
+	agent := RemotePath(Options.Agent)
+	remoteSum, _, err := ss.Output(sha256Expr(agent))
+	if err != nil {
+		return err
+	}
+	if remoteSum == localSum {
+		return nil
+	}
+
+	machine, _, err := ss.Output("uname -m")
+	if err != nil {
+		return err
+	}
+	if err = checkAgentArch(data, machine); err != nil {
+		return err
+	}
+
+	if Options.Debug {
+		fmt.Printf("upload %v to %v:%v\n", bin, remote, Options.Agent)
+	}
+	tmp := RemotePath(Options.Agent + ".tmp")
+	c, h, p, err := AllocProxy()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	recv, err := client.RecvCmd(remote, h, p)
+	if err != nil {
+		return err
+	}
+	// bash /dev/tcp first, which works whatever nc it has
+	cmd := fmt.Sprintf("mkdir -p \"$(dirname %v)\" && { %v 2>/dev/null || %v; } >%v",
+		agent, NCNone.Recv(h, p), recv, tmp)
+	if err = ss.Start(cmd); err != nil {
+		return err
+	}
+	go func() {
+		NewRC4Writer(c, p).Write(data)
+		c.Close()
+	}()
+	_, _, err = ss.Wait()
+	c.Close() // unblocks the writer if the remote failed to connect
+	if err != nil {
+		return err
+	}
+
+	remoteSum, _, err = ss.Output(sha256Expr(tmp))
+	if err != nil {
+		return err
+	}
+	if remoteSum != localSum {
+		ss.Run(fmt.Sprintf("rm -f %v", tmp))
+		return fmt.Errorf("%w: upload %v: checksum mismatch", errAgentUnusable, bin)
+	}
+	return ss.Run(fmt.Sprintf("chmod +x %v && mv -f %v %v", tmp, tmp, agent))
+}
+
+// agentMachines are `uname -m` prefixes of the elf machines.
+var agentMachines = map[elf.Machine][]string{
+	elf.EM_X86_64:    {"x86_64", "amd64"},
+	elf.EM_386:       {"i386", "i486", "i586", "i686", "x86_64"},
+	elf.EM_AARCH64:   {"aarch64", "arm64"},
+	elf.EM_ARM:       {"arm", "aarch64"},
+	elf.EM_RISCV:     {"riscv64"},
+	elf.EM_PPC64:     {"ppc64"},
+	elf.EM_S390:      {"s390"},
+	elf.EM_LOONGARCH: {"loongarch64"},
+	elf.EM_MIPS:      {"mips"},
+}
+
+// checkAgentArch checks the local agent binary runs on remote machine.
+func checkAgentArch(data []byte, machine string) error {
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%w: not a linux binary: %v", errAgentUnusable, err)
+	}
+	prefixes, ok := agentMachines[f.Machine]
+	if !ok {
+		return nil // unknown, let it try
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(machine, prefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: built for %v, but remote is %v", errAgentUnusable, f.Machine, machine)
+}
+
+func sha256Expr(path string) string {
+	return fmt.Sprintf("{ sha256sum %v || shasum -a 256 %v; } 2>/dev/null | cut -c1-64", path, path)
+}
+
+// AgentRemote runs `sncagent MODE -i CHANNEL1 -o CHANNEL2 ARGS` on remote,
+// and returns the conn to the data channels. ARGS must be quoted already.
+func (client *SSHClient) AgentRemote(remote, mode string, args ...string) (*RemoteConn, error) {
+	return client.pipeRemote(remote, func(h1, p1, h2, p2 string) (string, error) {
+		return agentLine(mode, h1, p1, h2, p2, args...), nil
+	})
+}
+
+func agentLine(mode, h1, p1, h2, p2 string, args ...string) string {
+	return fmt.Sprintf("%v %v -w %v -i %v -o %v %v", RemotePath(Options.Agent), mode, Options.Wait,
+		ShellQuote(net.JoinHostPort(h1, p1)), ShellQuote(net.JoinHostPort(h2, p2)), strings.Join(args, " "))
+}
+
+// AgentCopy copies a single file by sncagent get/put,
+// for remote hosts without rsync.
+func (client *SSHClient) AgentCopy(remote, file, local string, upload bool) error {
+	mode := "get"
+	if upload {
+		mode = "put"
+	}
+	rc, err := client.AgentRemote(remote, mode, RemotePath(file))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if upload {
+		f, err := os.Open(local)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return err
+		}
+		defer f.Close()
+		if _, err = io.Copy(rc, f); err != nil {
+			fmt.Fprintf(os.Stderr, "upload %v: %v\n", local, err)
+			return err
+		}
+		rc.CloseWrite()
+	}
+
+	br := bufio.NewReader(rc)
+	status, err := br.ReadString('\n')
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v %v: %v\n", mode, file, err)
+		return err
+	}
+	if status = strings.TrimSpace(status); status != "ok" {
+		err = errors.New(status)
+		fmt.Fprintf(os.Stderr, "%v %v: %v\n", mode, file, err)
+		return err
+	}
+	if upload {
+		return nil
+	}
+
+	f, err := os.Create(local)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	defer f.Close()
+	if _, err = io.Copy(f, br); err != nil {
+		fmt.Fprintf(os.Stderr, "download %v: %v\n", file, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Bastion logs in remote hosts through the jump server, and returns
+// their pty shells, which are set up by SSHClient.NewSession, so that
+// bastions differ only in the way to log in.
+type Bastion interface {
+	Login(host string) (*SSHSession, error)
+	Close() error
+}
+
+// Bastion types of profiles in config.
+const (
+	BastionJumpServer = "jumpserver" // the KoKo menu, the default
+	BastionOpenSSH    = "openssh"    // a plain sshd, then ssh on to hosts
+	BastionDirect     = "direct"     // no bastion, ssh to hosts directly
+)
+
+// Hops of openssh bastions.
+const (
+	HopDirectTCPIP = "direct-tcpip" // ssh to host over a tcp channel of the bastion, the default
+	HopSSH         = "ssh"          // run `ssh host` on the bastion
+)
+
+// NewBastion logs in jumper as the bastion type of the profile.
+func NewBastion() (Bastion, error) {
+	typ, hop := BastionJumpServer, ""
+	if p := Options.profile; p != nil {
+		if p.Bastion != "" {
+			typ = p.Bastion
+		}
+		hop = p.Hop
+	}
+	if typ == BastionDirect {
+		return new(Direct), nil
+	}
+
+	jumper, port := SplitHostPort(Options.Jumper, "22")
+	if Options.Debug {
+		fmt.Printf("%v ssh -p %v %v@%v\n", Dollar, port, Options.User, jumper)
+	}
+	sc, err := newSSHClient(net.JoinHostPort(jumper, port), Options.User)
+	if err != nil {
+		return nil, err
+	}
+
+	switch typ {
+	case BastionJumpServer:
+		return &JumpServer{sc: sc}, nil
+	case BastionOpenSSH:
+		if hop == "" {
+			hop = HopDirectTCPIP
+		}
+		return &OpenSSH{sc: sc, hop: hop}, nil
+	}
+	sc.Close()
+	err = fmt.Errorf("unknown bastion type %q", typ)
+	fmt.Fprintln(os.Stderr, err)
+	return nil, err
+}
+
+// OpenSSH is a plain ssh jump host, which logs in hosts as
+// `ssh -J jumper host` does, or by running ssh on it.
+type OpenSSH struct {
+	sc  *ssh.Client
+	hop string
+}
+
+func (o *OpenSSH) Close() error {
+	return o.sc.Close()
+}
+
+// Login logs in host as the account, or the user of jumper.
+func (o *OpenSSH) Login(host string) (*SSHSession, error) {
+	name, account := loginUser(host)
+	name, port := SplitHostPort(name, "22")
+
+	if o.hop == HopSSH {
+		// ssh prints login errors on the pty, and setupShell shows them
+		cmd := fmt.Sprintf("ssh -tt -o BatchMode=yes -p %v -l %v %v", ShellQuote(port), ShellQuote(account), ShellQuote(name))
+		if Options.Debug {
+			fmt.Printf("%v %v\n", Dollar, cmd)
+		}
+		return newSession(o.sc, cmd)
+	}
+
+	addr := net.JoinHostPort(name, port)
+	if Options.Debug {
+		fmt.Printf("%v ssh -J %v -p %v %v@%v\n", Dollar, Options.Jumper, port, account, name)
+	}
+	conn, err := o.sc.Dial("tcp", addr)
+	if err != nil {
+		err = fmt.Errorf("dial %q via jumper: %w", addr, err)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+	c, err := sshHandshake(conn, addr, account)
+	if err != nil {
+		return nil, err
+	}
+	ss, err := newSession(c, "")
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	ss.client = c
+	return ss, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Config is the optional json config file, see README for an example.
+type Config struct {
+	TLS      TLSConfig           `json:"tls"`
+	Forwards map[string][]string `json:"forwards"` // forward groups: name -> ["server[@remote][=listen]"]
+	Agent    string              `json:"agent"`    // local linux sncagent binary uploaded to remote hosts
+
+	Templates map[string]string      `json:"templates"` // remote command templates, see template.go
+	Hosts     map[string]*HostConfig `json:"hosts"`     // per remote host settings
+
+	Profile  string              `json:"profile"`  // the default profile
+	Profiles map[string]*Profile `json:"profiles"` // environments selected by --profile
+
+	dir   string // relative paths in config are relative to dir
+	tmpls map[string]*template.Template
+}
+
+// HostConfig is the settings of one remote host, overriding the global ones.
+type HostConfig struct {
+	Account   string            `json:"account"` // default system account on jumper
+	Comment   string            `json:"comment"` // shown by `snc hosts` of direct profiles
+	Templates map[string]string `json:"templates"`
+}
+
+// Profile is an environment: the bastion and the proxy to reach hosts.
+// Options given on the command line override the profile.
+type Profile struct {
+	Bastion string `json:"bastion"` // "jumpserver" (default), "openssh" or "direct"
+	Hop     string `json:"hop"`     // openssh: "direct-tcpip" (default) or "ssh"
+	Jumper  string `json:"jumper"`
+	User    string `json:"user"`
+	Proxy   string `json:"proxy"`
+}
+
+// ApplyProfile fills opts by the profile selected, if any.
+func (conf *Config) ApplyProfile(opts *RunOptions) error {
+	name := opts.Profile
+	if name == "" {
+		name = conf.Profile
+	}
+	if name == "" {
+		return nil
+	}
+	p := conf.Profiles[name]
+	if p == nil {
+		return fmt.Errorf("profile %q not found in config", name)
+	}
+	switch p.Bastion {
+	case "", BastionJumpServer, BastionOpenSSH, BastionDirect:
+	default:
+		return fmt.Errorf("profile %q: unknown bastion %q", name, p.Bastion)
+	}
+	switch p.Hop {
+	case "", HopDirectTCPIP, HopSSH:
+	default:
+		return fmt.Errorf("profile %q: unknown hop %q", name, p.Hop)
+	}
+
+	if opts.Jumper == "" {
+		opts.Jumper = p.Jumper
+	}
+	if opts.User == "" {
+		opts.User = p.User
+	}
+	if opts.Proxy == "" {
+		opts.Proxy = p.Proxy
+	}
+	opts.profile = p
+	return nil
+}
+
+// TLSConfig verifies sncd when proxy is "tls://" or "wss://".
+type TLSConfig struct {
+	CA          string `json:"ca"`          // pem file of the ca which signed sncd certificate
+	Fingerprint string `json:"fingerprint"` // sha256 of sncd certificate in hex, colons are allowed
+	ServerName  string `json:"server_name"` // default is the proxy host
+	Cert        string `json:"cert"`        // client certificate file for mutual tls
+	Key         string `json:"key"`         // client private key file for mutual tls
+}
+
+var Conf = new(Config)
+
+func defaultConfigPath() string {
+	home := getEnvHome()
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, ".snc", "config.json")
+}
+
+// LoadConfig loads config file path, or "$HOME/.snc/config.json"
+// if path is empty, and it is not an error if the default one not exists.
+func LoadConfig(path string) (*Config, error) {
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigPath()
+		if path == "" {
+			return new(Config), nil
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !explicit && errors.Is(err, fs.ErrNotExist) {
+			return new(Config), nil
+		}
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+
+	conf := new(Config)
+	err = json.Unmarshal(data, conf)
+	if err != nil {
+		return nil, fmt.Errorf("parse config %q: %w", path, err)
+	}
+	conf.dir = filepath.Dir(path)
+	if err = conf.parseTemplates(); err != nil {
+		return nil, fmt.Errorf("config %q: %w", path, err)
+	}
+	return conf, nil
+}
+
+// Path resolves a file path in config, "~/" is the home dir,
+// and relative paths are relative to the config file.
+func (conf *Config) Path(path string) string {
+	if path == "" {
+		return ""
+	}
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		return filepath.Join(getEnvHome(), rest)
+	}
+	if filepath.IsAbs(path) || conf.dir == "" {
+		return path
+	}
+	return filepath.Join(conf.dir, path)
+}
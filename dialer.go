@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dial connects to addr with timeout Options.Wait,
+// through the upstream proxy given by --via or environments:
+// ALL_PROXY, HTTPS_PROXY and NO_PROXY (or their lower case).
+//
+// Supported upstream proxies:
+//   - socks5://[user:pass@]host:port, socks5h:// is the same, dns is resolved by proxy;
+//   - http://[user:pass@]host:port and https://[user:pass@]host:port, by CONNECT method.
+func Dial(addr string) (net.Conn, error) {
+	timeout := time.Duration(Options.Wait) * time.Second
+	via, err := upstreamProxy(addr)
+	if err != nil {
+		return nil, err
+	}
+	if via == nil {
+		return net.DialTimeout(Network("tcp"), addr, timeout)
+	}
+	if Options.Debug {
+		fmt.Printf("dial %v via %v\n", addr, via.Redacted())
+	}
+
+	proxyAddr := via.Host
+	if via.Port() == "" {
+		switch via.Scheme {
+		case "socks5", "socks5h":
+			proxyAddr = net.JoinHostPort(via.Hostname(), "1080")
+		case "http":
+			proxyAddr = net.JoinHostPort(via.Hostname(), "80")
+		case "https":
+			proxyAddr = net.JoinHostPort(via.Hostname(), "443")
+		}
+	}
+
+	conn, err := net.DialTimeout(Network("tcp"), proxyAddr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("dial upstream proxy %q: %w", proxyAddr, err)
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			conn.Close()
+		}
+	}()
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	switch via.Scheme {
+	case "socks5", "socks5h":
+		err = socks5Connect(conn, via.User, addr)
+	case "https":
+		tc := tls.Client(conn, &tls.Config{ServerName: via.Hostname()})
+		if err = tc.Handshake(); err != nil {
+			err = fmt.Errorf("tls handshake: %w", err)
+			break
+		}
+		conn = tc
+		fallthrough
+	case "http":
+		conn, err = httpConnect(conn, via.User, addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connect %q via upstream proxy %q: %w", addr, proxyAddr, err)
+	}
+
+	conn.SetDeadline(time.Time{})
+	ok = true
+	return conn, nil
+}
+
+// upstreamProxy returns the upstream proxy for addr, nil means dial directly.
+func upstreamProxy(addr string) (*url.URL, error) {
+	via := Options.Via
+	if via == "" {
+		via = getEnvAny("ALL_PROXY", "all_proxy", "HTTPS_PROXY", "https_proxy")
+	}
+	if via == "" || via == "direct" {
+		return nil, nil
+	}
+	if noProxy(addr, getEnvAny("NO_PROXY", "no_proxy")) {
+		return nil, nil
+	}
+
+	if !strings.Contains(via, "://") {
+		via = "http://" + via
+	}
+	u, err := url.Parse(via)
+	if err != nil {
+		return nil, fmt.Errorf("parse upstream proxy %q: %w", via, err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http", "https":
+		return u, nil
+	}
+	return nil, fmt.Errorf("unsupported upstream proxy scheme %q", u.Scheme)
+}
+
+func getEnvAny(keys ...string) string {
+	for _, key := range keys {
+		if value := os.Getenv(key); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// noProxy reports whether addr matches the NO_PROXY list, which is
+// comma separated "*", ip, cidr, or domain suffix with optional port.
+func noProxy(addr, list string) bool {
+	host, port := SplitHostPort(addr, "")
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if ip != nil {
+			if _, cidr, err := net.ParseCIDR(entry); err == nil {
+				if cidr.Contains(ip) {
+					return true
+				}
+				continue
+			}
+		}
+
+		name, p := entry, ""
+		if h, pp, err := net.SplitHostPort(entry); err == nil {
+			name, p = h, pp
+		}
+		if p != "" && p != port {
+			continue
+		}
+		if eip := net.ParseIP(strings.Trim(name, "[]")); eip != nil {
+			if ip != nil && eip.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		name = strings.TrimPrefix(strings.TrimPrefix(name, "*"), ".")
+		if host == name || strings.HasSuffix(host, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+func socks5Connect(conn net.Conn, user *url.Userinfo, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	// greeting
+	methods := []byte{0x00} // no authentication
+	if user != nil {
+		methods = []byte{0x02} // username/password
+	}
+	_, err = conn.Write(append([]byte{0x05, byte(len(methods))}, methods...))
+	if err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err = io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return fmt.Errorf("socks version %v not supported", reply[0])
+	}
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		if user == nil {
+			return errors.New("socks5 authentication required")
+		}
+		name := user.Username()
+		pass, _ := user.Password()
+		if len(name) > 255 || len(pass) > 255 {
+			return errors.New("socks5 username or password too long")
+		}
+		req := []byte{0x01, byte(len(name))}
+		req = append(req, name...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err = conn.Write(req); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("socks5 authentication failed")
+		}
+	default:
+		return errors.New("no acceptable socks5 authentication method")
+	}
+
+	// connect
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(req, 0x01)
+		req = append(req, ip.To4()...)
+	} else if ip != nil {
+		req = append(req, 0x04)
+		req = append(req, ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %q too long", host)
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+
+	var hdr [4]byte
+	if _, err = io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[1] != 0x00 {
+		return fmt.Errorf("socks5 connect failed, reply code %v", hdr[1])
+	}
+	var skip int
+	switch hdr[3] {
+	case 0x01:
+		skip = net.IPv4len + 2
+	case 0x04:
+		skip = net.IPv6len + 2
+	case 0x03:
+		var l [1]byte
+		if _, err = io.ReadFull(conn, l[:]); err != nil {
+			return err
+		}
+		skip = int(l[0]) + 2
+	default:
+		return fmt.Errorf("socks5 unknown address type %v", hdr[3])
+	}
+	_, err = io.CopyN(io.Discard, conn, int64(skip))
+	return err
+}
+
+// bufferedConn returns bytes buffered while reading CONNECT response first.
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(p []byte) (int, error) {
+	return bc.br.Read(p)
+}
+
+func httpConnect(conn net.Conn, user *url.Userinfo, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		pass, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http connect: %v", resp.Status)
+	}
+	if br.Buffered() == 0 {
+		return conn, nil
+	}
+	return &bufferedConn{Conn: conn, br: br}, nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// socks5Stub serves one socks5 CONNECT on conn: it requires user:pass
+// if user is not empty, replies code, and then writes "hi" if succeeded.
+// It returns the requested address.
+func socks5Stub(conn net.Conn, user, pass string, code byte) (addr string, err error) {
+	defer conn.Close()
+	var hdr [2]byte
+	if _, err = io.ReadFull(conn, hdr[:]); err != nil {
+		return
+	}
+	methods := make([]byte, hdr[1])
+	if _, err = io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	if user == "" {
+		conn.Write([]byte{0x05, 0x00})
+	} else {
+		conn.Write([]byte{0x05, 0x02})
+		var b [1]byte
+		io.ReadFull(conn, b[:]) // version
+		io.ReadFull(conn, b[:])
+		name := make([]byte, b[0])
+		io.ReadFull(conn, name)
+		io.ReadFull(conn, b[:])
+		pw := make([]byte, b[0])
+		io.ReadFull(conn, pw)
+		if string(name) != user || string(pw) != pass {
+			conn.Write([]byte{0x01, 0x01})
+			return
+		}
+		conn.Write([]byte{0x01, 0x00})
+	}
+
+	var req [4]byte
+	if _, err = io.ReadFull(conn, req[:]); err != nil {
+		return
+	}
+	var host string
+	switch req[3] {
+	case 0x01, 0x04:
+		ip := make(net.IP, 4)
+		if req[3] == 0x04 {
+			ip = make(net.IP, 16)
+		}
+		io.ReadFull(conn, ip)
+		host = ip.String()
+	case 0x03:
+		var l [1]byte
+		io.ReadFull(conn, l[:])
+		name := make([]byte, l[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	}
+	var p [2]byte
+	if _, err = io.ReadFull(conn, p[:]); err != nil {
+		return
+	}
+	addr = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(p[:]))))
+
+	// bind address as a domain name, which the client must skip
+	reply := []byte{0x05, code, 0x00, 0x03, 4, 'b', 'i', 'n', 'd', 0, 0}
+	conn.Write(reply)
+	if code == 0x00 {
+		conn.Write([]byte("hi"))
+	}
+	return
+}
+
+func TestSocks5Connect(t *testing.T) {
+	tests := []struct {
+		name       string
+		addr       string
+		user       *url.Userinfo
+		stubUser   string
+		code       byte
+		wantTarget string
+		ok         bool
+	}{
+		{"domain", "example.com:443", nil, "", 0, "example.com:443", true},
+		{"ipv4", "10.0.0.1:80", nil, "", 0, "10.0.0.1:80", true},
+		{"ipv6", "[fd00::1]:22", nil, "", 0, "[fd00::1]:22", true},
+		{"auth", "example.com:80", url.UserPassword("u", "p"), "u", 0, "example.com:80", true},
+		{"wrong password", "example.com:80", url.UserPassword("u", "x"), "u", 0, "", false},
+		{"auth required", "example.com:80", nil, "u", 0, "", false},
+		{"refused", "example.com:80", nil, "", 0x05, "example.com:80", false},
+	}
+	for _, tt := range tests {
+		c1, c2 := net.Pipe()
+		target := make(chan string, 1)
+		go func() {
+			addr, _ := socks5Stub(c2, tt.stubUser, "p", tt.code)
+			target <- addr
+		}()
+
+		err := socks5Connect(c1, tt.user, tt.addr)
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: socks5Connect = %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if err == nil {
+			data := make([]byte, 2)
+			if _, err = io.ReadFull(c1, data); err != nil || string(data) != "hi" {
+				t.Errorf("%v: read after connect %q, %v", tt.name, data, err)
+			}
+		}
+		c1.Close()
+		if got := <-target; got != tt.wantTarget {
+			t.Errorf("%v: stub got target %q, want %q", tt.name, got, tt.wantTarget)
+		}
+	}
+}
+
+// connectStub serves one CONNECT on conn, and replies status, with data
+// right after the response if succeeded. It returns the request.
+func connectStub(conn net.Conn, status int, data string) (*http.Request, error) {
+	defer conn.Close()
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return nil, err
+	}
+	resp := "HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) + "\r\n\r\n"
+	if status == http.StatusOK {
+		resp += data
+	}
+	conn.Write([]byte(resp))
+	return req, nil
+}
+
+func TestHTTPConnect(t *testing.T) {
+	tests := []struct {
+		name   string
+		user   *url.Userinfo
+		status int
+		data   string
+		auth   string
+	}{
+		{"ok", nil, http.StatusOK, "", ""},
+		{"server speaks first", nil, http.StatusOK, "SSH-2.0-x\r\n", ""},
+		{"basic auth", url.UserPassword("u", "p"), http.StatusOK, "", "Basic dTpw"},
+		{"auth required", nil, http.StatusProxyAuthRequired, "", ""},
+	}
+	for _, tt := range tests {
+		c1, c2 := net.Pipe()
+		reqs := make(chan *http.Request, 1)
+		go func() {
+			req, _ := connectStub(c2, tt.status, tt.data)
+			reqs <- req
+		}()
+
+		conn, err := httpConnect(c1, tt.user, "example.com:22")
+		if (err == nil) != (tt.status == http.StatusOK) {
+			t.Errorf("%v: httpConnect = %v, want status %v", tt.name, err, tt.status)
+		}
+		if err == nil && tt.data != "" {
+			got := make([]byte, len(tt.data))
+			if _, err = io.ReadFull(conn, got); err != nil || string(got) != tt.data {
+				t.Errorf("%v: read buffered %q, %v, want %q", tt.name, got, err, tt.data)
+			}
+		}
+		c1.Close()
+
+		req := <-reqs
+		if req == nil {
+			t.Errorf("%v: stub read no request", tt.name)
+			continue
+		}
+		if req.Method != http.MethodConnect || req.Host != "example.com:22" {
+			t.Errorf("%v: request %v %v, want CONNECT example.com:22", tt.name, req.Method, req.Host)
+		}
+		if auth := req.Header.Get("Proxy-Authorization"); auth != tt.auth {
+			t.Errorf("%v: Proxy-Authorization %q, want %q", tt.name, auth, tt.auth)
+		}
+	}
+}
+
+// TestDialVia dials through stub proxies on the loopback by --via.
+func TestDialVia(t *testing.T) {
+	defer func(opts *RunOptions) { Options = opts }(Options)
+	t.Setenv("NO_PROXY", "")
+	t.Setenv("no_proxy", "")
+
+	for _, scheme := range []string{"socks5", "http"} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := make(chan string, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if scheme == "socks5" {
+				addr, _ := socks5Stub(conn, "", "", 0)
+				target <- addr
+			} else {
+				req, _ := connectStub(conn, http.StatusOK, "hi")
+				target <- req.Host
+			}
+		}()
+
+		Options = &RunOptions{Via: scheme + "://" + ln.Addr().String(), Wait: 5}
+		conn, err := Dial("example.com:80")
+		if err != nil {
+			t.Errorf("dial via %v: %v", scheme, err)
+		} else {
+			data, _ := io.ReadAll(conn)
+			if string(data) != "hi" {
+				t.Errorf("dial via %v: read %q, want hi", scheme, data)
+			}
+			conn.Close()
+			if got := <-target; got != "example.com:80" {
+				t.Errorf("dial via %v: proxy got %q", scheme, got)
+			}
+		}
+		ln.Close()
+	}
+}
+
+func TestNoProxy(t *testing.T) {
+	tests := []struct {
+		addr, list string
+		match      bool
+	}{
+		{"example.com:443", "", false},
+		{"example.com:443", "*", true},
+		{"example.com:443", "example.com", true},
+		{"api.example.com:443", "example.com", true},
+		{"api.example.com:443", ".example.com", true},
+		{"api.example.com:443", "*.example.com", true},
+		{"badexample.com:443", "example.com", false},
+		{"example.com:443", "example.com:443", true},
+		{"example.com:8443", "example.com:443", false},
+		{"EXAMPLE.com:443", " foo.org , Example.COM ", true},
+		{"10.1.2.3:22", "10.0.0.0/8", true},
+		{"11.1.2.3:22", "10.0.0.0/8", false},
+		{"10.1.2.3:22", "10.1.2.3", true},
+		{"10.1.2.3:22", "10.1.2.3:23", false},
+		{"[fd00::1]:22", "fd00::/8", true},
+		{"[fd00::1]:22", "[fd00::1]:22", true},
+		{"[fd00::1]:22", "fd00::2", false},
+	}
+	for _, tt := range tests {
+		if match := noProxy(tt.addr, tt.list); match != tt.match {
+			t.Errorf("noProxy(%q, %q) = %v, want %v", tt.addr, tt.list, match, tt.match)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Direct is the bastion of hosts reachable without a jump server:
+// snc logs in them by ssh directly, and uses plain ssh channels,
+// direct-tcpip for forwards and exec for commands, instead of sncd
+// data channels and commands typed into a pty.
+type Direct struct {
+	mu      sync.Mutex
+	clients map[string]*ssh.Client  // host -> client
+	logins  map[string]*directLogin // host -> login in progress
+	closed  bool
+}
+
+// directLogin is a login in progress, which the others of the same host
+// wait for, instead of logging in again or blocking other hosts.
+type directLogin struct {
+	done   chan struct{}
+	client *ssh.Client
+	err    error
+}
+
+func (d *Direct) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, c := range d.clients {
+		c.Close()
+	}
+	d.clients = nil
+	d.closed = true
+	return nil
+}
+
+// Client returns the ssh client logged in host, one per host.
+// Host "hostA/hostB" is logged in through a direct-tcpip channel of hostA.
+func (d *Direct) Client(host string) (*ssh.Client, error) {
+	d.mu.Lock()
+	if c := d.clients[host]; c != nil {
+		d.mu.Unlock()
+		return c, nil
+	}
+	if l := d.logins[host]; l != nil {
+		d.mu.Unlock()
+		<-l.done
+		return l.client, l.err
+	}
+	if d.closed {
+		d.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	l := &directLogin{done: make(chan struct{})}
+	if d.logins == nil {
+		d.logins = make(map[string]*directLogin)
+	}
+	d.logins[host] = l
+	d.mu.Unlock()
+
+	c, err := d.login(host)
+
+	d.mu.Lock()
+	delete(d.logins, host)
+	if err == nil && d.closed {
+		c.Close()
+		c, err = nil, net.ErrClosed
+	}
+	if err == nil {
+		if d.clients == nil {
+			d.clients = make(map[string]*ssh.Client)
+		}
+		d.clients[host] = c
+		go func() {
+			c.Wait()
+			d.mu.Lock()
+			if d.clients[host] == c {
+				delete(d.clients, host)
+			}
+			d.mu.Unlock()
+		}()
+	}
+	d.mu.Unlock()
+	l.client, l.err = c, err
+	close(l.done)
+	return c, err
+}
+
+func (d *Direct) login(host string) (*ssh.Client, error) {
+	prev, hop := "", host
+	if i := strings.LastIndexByte(host, '/'); i >= 0 {
+		prev, hop = host[:i], host[i+1:]
+	}
+	name, user := loginUser(hop)
+	name, port := SplitHostPort(name, "22")
+	addr := net.JoinHostPort(name, port)
+	if Options.Debug {
+		fmt.Printf("%v ssh -p %v %v@%v\n", Dollar, port, user, name)
+	}
+	if prev == "" {
+		return newSSHClient(addr, user)
+	}
+
+	pc, err := d.Client(prev)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := pc.Dial("tcp", addr)
+	if err != nil {
+		err = fmt.Errorf("dial %q via %q: %w", addr, prev, err)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+	return sshHandshake(conn, addr, user)
+}
+
+// Login returns a pty shell of host, for the few commands run in a shell.
+func (d *Direct) Login(host string) (*SSHSession, error) {
+	c, err := d.Client(host)
+	if err != nil {
+		return nil, err
+	}
+	return newSession(c, "")
+}
+
+// Dial connects to addr, "host:port" or a unix socket path, from host.
+func (d *Direct) Dial(host, network, addr string) (Stream, error) {
+	c, err := d.Client(host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.Dial(network, addr)
+	if err != nil {
+		err = fmt.Errorf("%v dial %v %q: %w", host, network, addr, err)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+	return conn.(Stream), nil
+}
+
+// Exec runs cmd on host by an exec channel, and returns the conn
+// to its stdin and stdout, stderr goes to local stderr.
+func (d *Direct) Exec(host, cmd string) (*ExecConn, error) {
+	c, err := d.Client(host)
+	if err != nil {
+		return nil, err
+	}
+	session, err := c.NewSession()
+	if err != nil {
+		err = fmt.Errorf("ssh open new session: %w", err)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+	w, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		fmt.Fprintf(os.Stderr, "ssh get stdin: %v\n", err)
+		return nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		fmt.Fprintf(os.Stderr, "ssh get stdout: %v\n", err)
+		return nil, err
+	}
+	session.Stderr = os.Stderr
+	if Options.Debug {
+		fmt.Println(cmd)
+	}
+	if err = session.Start(cmd); err != nil {
+		session.Close()
+		fmt.Fprintf(os.Stderr, "ssh run `%v`: %v\n", cmd, err)
+		return nil, err
+	}
+	return &ExecConn{session: session, host: host, w: w, r: r}, nil
+}
+
+// loginUser splits host to log in directly, and the user to log in as:
+// the account of host, or the ssh user.
+func loginUser(host string) (name, user string) {
+	name, user = hostAccount(host)
+	if user == "" {
+		user = Options.User
+	}
+	return
+}
+
+// ExecConn is a conn to the stdin and stdout of a command run by an ssh
+// exec channel.
+type ExecConn struct {
+	session *ssh.Session
+	host    string
+	w       io.WriteCloser
+	r       io.Reader
+}
+
+func (ec *ExecConn) Read(p []byte) (int, error) {
+	return ec.r.Read(p)
+}
+
+func (ec *ExecConn) Write(p []byte) (int, error) {
+	return ec.w.Write(p)
+}
+
+// CloseWrite closes stdin, then the command sees EOF.
+func (ec *ExecConn) CloseWrite() error {
+	return ec.w.Close()
+}
+
+func (ec *ExecConn) Close() error {
+	return ec.session.Close()
+}
+
+type execAddr string
+
+func (a execAddr) Network() string { return "ssh" }
+func (a execAddr) String() string  { return string(a) }
+
+func (ec *ExecConn) LocalAddr() net.Addr  { return execAddr("local") }
+func (ec *ExecConn) RemoteAddr() net.Addr { return execAddr(ec.host) }
+
+// Deadlines are not supported.
+func (ec *ExecConn) SetDeadline(t time.Time) error      { return nil }
+func (ec *ExecConn) SetReadDeadline(t time.Time) error  { return nil }
+func (ec *ExecConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"time"
+)
+
+// Expect is a small expect engine over the pty output of a session:
+// reads are buffered by a background reader, so every step can wait
+// for literal or regexp alternatives with its own timeout, and the
+// recent output is kept as a transcript for error messages.
+type Expect struct {
+	chunks chan []byte
+	err    error // read error after chunks closed
+	buf    []byte
+	trans  []byte // recent output, at most transcriptSize
+}
+
+const transcriptSize = 2048
+
+// Pattern is a literal or regexp alternative to wait for.
+type Pattern struct {
+	lit string
+	re  *regexp.Regexp
+}
+
+func Literal(s string) Pattern {
+	return Pattern{lit: s}
+}
+
+func Regexp(expr string) Pattern {
+	return Pattern{re: regexp.MustCompile(expr)}
+}
+
+// find returns the leftmost match [start, end) in b, or nil.
+func (p Pattern) find(b []byte) []int {
+	if p.re != nil {
+		return p.re.FindIndex(b)
+	}
+	if i := bytes.Index(b, []byte(p.lit)); i >= 0 {
+		return []int{i, i + len(p.lit)}
+	}
+	return nil
+}
+
+// ExpectError tells which step failed, and what the remote said last.
+type ExpectError struct {
+	Step       string
+	Timeout    time.Duration // non-zero if timed out
+	Err        error         // read error if not timed out
+	Transcript []byte
+}
+
+func (e *ExpectError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("timeout after %v waiting for %v, last output: %q", e.Timeout, e.Step, e.Transcript)
+	}
+	return fmt.Sprintf("waiting for %v: %v, last output: %q", e.Step, e.Err, e.Transcript)
+}
+
+func (e *ExpectError) Unwrap() error {
+	return e.Err
+}
+
+func NewExpect(r io.Reader) *Expect {
+	e := &Expect{chunks: make(chan []byte, 16)}
+	go func() {
+		defer close(e.chunks)
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := r.Read(buf)
+			if n > 0 {
+				e.chunks <- buf[:n]
+			}
+			if err != nil {
+				e.err = err
+				return
+			}
+		}
+	}()
+	return e
+}
+
+// Expect waits until any of patterns appears in the output, at most
+// timeout (0 is forever). It consumes the output to the end of the
+// leftmost match, and returns the index of the pattern and the output.
+func (e *Expect) Expect(step string, timeout time.Duration, patterns ...Pattern) (int, []byte, error) {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		idx, end := -1, 0
+		var start int
+		for i, p := range patterns {
+			if m := p.find(e.buf); m != nil && (idx < 0 || m[0] < start) {
+				idx, start, end = i, m[0], m[1]
+			}
+		}
+		if idx >= 0 {
+			out := e.buf[:end:end]
+			e.buf = e.buf[end:]
+			if Options.Debug {
+				os.Stdout.Write(out)
+			}
+			return idx, out, nil
+		}
+
+		select {
+		case chunk, ok := <-e.chunks:
+			if !ok {
+				return -1, nil, &ExpectError{Step: step, Err: e.err, Transcript: bytes.Clone(e.trans)}
+			}
+			e.buf = append(e.buf, chunk...)
+			e.trans = append(e.trans, chunk...)
+			if n := len(e.trans); n > transcriptSize {
+				e.trans = e.trans[n-transcriptSize:]
+			}
+		case <-deadline:
+			return -1, nil, &ExpectError{Step: step, Timeout: timeout, Transcript: bytes.Clone(e.trans)}
+		}
+	}
+}
@@ -2,109 +2,265 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"regexp"
 	"strings"
 	"sync"
+	"text/tabwriter"
+	"time"
 )
 
 type ForwardOptions struct {
-	Server string `required:"true" desc:"the server address forward to, format: 'host:port'"`
-	Remote string `required:"true" desc:"the remote host name or ip forward via"`
-	Listen string `short:"l" long:"listen" desc:"local listen address, default is the port of server address"`
+	Specs  []string `desc:"forward specs 'server[@remote][=listen]', server format: 'host:port' or 'unix:/path/to/socket'; a trailing bare host is the default remote"`
+	Remote string   `short:"r" long:"remote" desc:"the default remote host name or ip forward via"`
+	Group  string   `short:"g" long:"group" desc:"forward specs group name in config"`
+	Listen string   `short:"l" long:"listen" desc:"local listen address or 'unix:/path/to/socket' of the only spec, default is the port of server address"`
+
+	UDP        bool  `long:"udp" desc:"forward udp datagrams instead of tcp, relayed by sncagent or perl on remote"`
+	UDPTimeout int64 `long:"udp-timeout" dft:"60" desc:"udp client session idle timeout seconds"`
 }
 
-func TCPForward(ctx context.Context, opts *ForwardOptions) {
-	host, port, _ := net.SplitHostPort(opts.Server)
-	if host == "" || port == "" {
-		fmt.Fprintln(os.Stderr, "server address invalid, format: 'host:port'")
-		return
+// ForwardSpec is one forward: server@remote=listen.
+type ForwardSpec struct {
+	Server string
+	Remote string
+	Listen string
+
+	host string
+	port string
+	unix string // remote unix socket path
+}
+
+// ParseForwardSpec parses "server[@remote][=listen]",
+// remote and listen are optional with default values.
+func ParseForwardSpec(s, dftRemote, dftListen string) (*ForwardSpec, error) {
+	spec := &ForwardSpec{Remote: dftRemote, Listen: dftListen}
+	s, listen, ok := strings.Cut(s, "=")
+	if ok {
+		spec.Listen = listen
 	}
+	// the remote may be "host@account"
+	if idx := strings.IndexByte(s, '@'); idx >= 0 {
+		s, spec.Remote = s[:idx], s[idx+1:]
+	}
+	spec.Server = s
 
-	if opts.Remote == "" {
-		fmt.Fprintln(os.Stderr, "remote host is empty")
-		return
+	if path, ok := strings.CutPrefix(spec.Server, "unix:"); ok {
+		if !validSocketPath.MatchString(path) {
+			return nil, fmt.Errorf("unix socket path %q invalid", path)
+		}
+		if spec.Listen == "" {
+			return nil, fmt.Errorf("%v: listen address is required for unix socket server", spec.Server)
+		}
+		spec.unix = path
+	} else {
+		spec.host, spec.port, _ = net.SplitHostPort(spec.Server)
+		if spec.host == "" || spec.port == "" {
+			return nil, fmt.Errorf("server address %q invalid, format: 'host:port' or 'unix:/path/to/socket'", spec.Server)
+		}
 	}
 
-	if opts.Listen == "" {
-		opts.Listen = port
+	if spec.Remote == "" {
+		return nil, fmt.Errorf("%v: remote host is empty", spec.Server)
 	}
-	if !strings.Contains(opts.Listen, ":") {
-		opts.Listen = "127.0.0.1:" + opts.Listen
+	if spec.Listen == "" {
+		spec.Listen = spec.port
 	}
+	spec.Listen = ListenAddr(spec.Listen)
+	return spec, nil
+}
 
-	client, err := NewSSHClient()
+func parseForwardSpecs(opts *ForwardOptions) ([]*ForwardSpec, error) {
+	args := opts.Specs
+	// compatible with `snc f server remote`
+	if n := len(args); n > 1 && !isForwardSpec(args[n-1]) {
+		if opts.Remote != "" {
+			return nil, fmt.Errorf("remote host given by both %q and --remote", args[n-1])
+		}
+		opts.Remote, args = args[n-1], args[:n-1]
+	}
+	if opts.Group != "" {
+		group, ok := Conf.Forwards[opts.Group]
+		if !ok {
+			return nil, fmt.Errorf("forward group %q not found in config", opts.Group)
+		}
+		args = append(args, group...)
+	}
+	if len(args) == 0 {
+		return nil, errors.New("no forward specified")
+	}
+	if opts.Listen != "" && len(args) > 1 {
+		return nil, errors.New("--listen is only for a single forward, use 'server=listen' instead")
+	}
+
+	specs := make([]*ForwardSpec, 0, len(args))
+	for _, arg := range args {
+		spec, err := ParseForwardSpec(arg, opts.Remote, opts.Listen)
+		if err != nil {
+			return nil, err
+		}
+		if opts.UDP && spec.unix != "" {
+			return nil, fmt.Errorf("%v: udp cannot forward to unix socket", spec.Server)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// isForwardSpec reports whether arg has a server address,
+// or else it is a bare remote host, which may be an ipv6 address.
+func isForwardSpec(arg string) bool {
+	if strings.Contains(arg, "=") {
+		return true
+	}
+	if idx := strings.IndexByte(arg, '@'); idx >= 0 {
+		arg = arg[:idx]
+	}
+	if strings.HasPrefix(arg, "unix:") {
+		return true
+	}
+	host, port, err := net.SplitHostPort(arg)
+	return err == nil && host != "" && port != ""
+}
+
+// TCPForward serves all forwards with one jumper login.
+func TCPForward(ctx context.Context, opts *ForwardOptions) {
+	specs, err := parseForwardSpecs(opts)
 	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		return
 	}
+	if opts.UDPTimeout <= 0 {
+		opts.UDPTimeout = 60
+	}
 
-	listener, err := net.Listen("tcp4", opts.Listen)
+	client, err := NewSSHClient()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "local listen %q: %v\n", opts.Listen, err)
 		return
 	}
-	defer listener.Close()
+	defer client.Close()
+
+	serves := make([]func(), 0, len(specs))
+	for _, spec := range specs {
+		if opts.UDP {
+			pc, err := net.ListenPacket(Network("udp"), spec.Listen)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "local listen udp %q: %v\n", spec.Listen, err)
+				return
+			}
+			defer pc.Close()
+			timeout := time.Duration(opts.UDPTimeout) * time.Second
+			serves = append(serves, func() { UDPForward(client, spec, pc, timeout) })
+			continue
+		}
+
+		listener, err := Listen(spec.Listen)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "local listen %q: %v\n", spec.Listen, err)
+			return
+		}
+		defer listener.Close()
+		serves = append(serves, func() { serveForward(client, spec, listener) })
+	}
+
+	printForwards(specs, opts.UDP)
+	for _, spec := range specs {
+		// warm up before the first connection
+		if _, ok := client.bastion.(*Direct); ok {
+			break // no pty sessions or tunnels
+		}
+		if Options.Tunnel && !opts.UDP {
+			go client.Tunnel(spec.Remote)
+		} else {
+			client.Pool(spec.Remote)
+		}
+	}
+
+	wg := new(sync.WaitGroup)
+	for _, serve := range serves {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve()
+		}()
+	}
+	wg.Wait()
+}
 
+func printForwards(specs []*ForwardSpec, udp bool) {
+	proto := "tcp"
+	if udp {
+		proto = "udp"
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "LISTEN\tPROTO\tSERVER\tREMOTE")
+	for _, spec := range specs {
+		p := proto
+		if spec.unix != "" {
+			p = "unix"
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", spec.Listen, p, spec.Server, spec.Remote)
+	}
+	tw.Flush()
+}
+
+func serveForward(client *SSHClient, spec *ForwardSpec, listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			fmt.Fprintf(os.Stderr, "local accept conn: %v\n", err)
 			continue
 		}
-		go forward(client, opts, host, port, conn)
+		go forward(client, spec, conn)
 	}
 }
 
-func forward(client *SSHClient, opts *ForwardOptions, host string, port string, conn net.Conn) {
+func forward(client *SSHClient, spec *ForwardSpec, conn net.Conn) {
 	defer conn.Close()
-	ssh, err := client.NewSession(opts.Remote)
-	if err != nil {
-		return
+	var rc Stream
+	var err error
+	if spec.unix != "" {
+		rc, err = client.DialRemoteUnix(spec.Remote, spec.unix)
+	} else {
+		rc, err = client.DialRemote(spec.Remote, spec.host, spec.port)
 	}
-	defer ssh.Close()
-	defer ssh.Stdin.Close()
-	// defer ssh.Quit()
-	// defer ssh.WaitPS1()
-
-	c1, h1, p1, e1 := AllocProxy()
-	if e1 != nil {
-		return
-	}
-	defer c1.Close()
-	c2, h2, p2, e2 := AllocProxy()
-	if e2 != nil {
-		return
-	}
-	defer c2.Close()
-
-	cmd := fmt.Sprintf("nc -4 -w %v --recv-only %v %v | nc -4 -w %v %v %v | nc -4 -w %v --send-only %v %v\r",
-		Options.Wait, h1, p1, Options.Wait, host, port, Options.Wait, h2, p2)
-	if Options.Debug {
-		fmt.Println(cmd)
-	}
-	_, err = ssh.Stdin.Write([]byte(cmd))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "write cmd: %v\n", err)
 		return
 	}
+	defer rc.Close()
+	Pipe(conn, rc)
+}
 
+// Stream is a conn to remote, either a *RemoteConn or a tunnel *MuxStream.
+type Stream interface {
+	net.Conn
+	CloseWrite() error
+}
+
+// Pipe copies data between local conn and remote conn until both done.
+func Pipe(conn net.Conn, rc Stream) {
 	wg := new(sync.WaitGroup)
 	wg.Add(2)
 
 	go func() {
 		defer wg.Done()
-		_, err := io.Copy(NewRC4Writer(c1, p1), conn)
+		_, err := io.Copy(rc, conn)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "local -> ssh: %v\n", err)
 		}
-		c1.Close()
+		rc.CloseWrite()
 	}()
 
 	go func() {
 		defer wg.Done()
-		_, err := io.Copy(conn, NewRC4Reader(c2, p2))
+		_, err := io.Copy(conn, rc)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "ssh -> local: %v\n", err)
 		}
@@ -113,3 +269,155 @@ func forward(client *SSHClient, opts *ForwardOptions, host string, port string,
 
 	wg.Wait()
 }
+
+// RemoteConn is a conn to a remote command, mostly `nc HOST PORT`, run by
+// `nc --recv-only CHANNEL1 | cmd | nc --send-only CHANNEL2`:
+// written data goes to CHANNEL1, and read data comes from CHANNEL2.
+type RemoteConn struct {
+	ssh *SSHSession
+	c1  net.Conn
+	c2  net.Conn
+	w   io.Writer
+	r   io.Reader
+}
+
+// DialRemote connects to host:port from remote via the proxy data channels,
+// or via the tunnel of remote if --tunnel.
+func (client *SSHClient) DialRemote(remote, host, port string) (Stream, error) {
+	if d, ok := client.bastion.(*Direct); ok {
+		return d.Dial(remote, "tcp", net.JoinHostPort(host, port))
+	}
+	if Options.Tunnel {
+		return client.OpenTunnel(remote, net.JoinHostPort(host, port))
+	}
+	if client.Agent(remote) {
+		return client.AgentRemote(remote, "dial", ShellQuote(net.JoinHostPort(host, port)))
+	}
+	cmd, err := client.ConnectCmd(remote, host, port)
+	if err != nil {
+		return nil, err
+	}
+	return client.PipeRemote(remote, cmd)
+}
+
+// validSocketPath avoids any shell special characters in the socket path.
+var validSocketPath = regexp.MustCompile(`^[A-Za-z0-9._/+-]+$`)
+
+// DialRemoteUnix connects to unix socket path on remote via the proxy data channels.
+func (client *SSHClient) DialRemoteUnix(remote, path string) (Stream, error) {
+	if d, ok := client.bastion.(*Direct); ok {
+		return d.Dial(remote, "unix", path)
+	}
+	if Options.Tunnel {
+		return client.OpenTunnel(remote, "unix:"+path)
+	}
+	if client.Agent(remote) {
+		return client.AgentRemote(remote, "dial", ShellQuote("unix:"+path))
+	}
+	cmd, err := client.UnixCmd(remote, path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", remote, err)
+		return nil, err
+	}
+	return client.PipeRemote(remote, cmd)
+}
+
+// PipeRemote runs `nc --recv-only CHANNEL1 | cmd | nc --send-only CHANNEL2`
+// on remote, in the way of its nc flavor, or `sncagent exec -i CHANNEL1 -o CHANNEL2 -- cmd` if the agent
+// is available, or by an exec channel if direct, and returns the conn to
+// cmd's stdin and stdout.
+func (client *SSHClient) PipeRemote(remote, cmd string) (Stream, error) {
+	if d, ok := client.bastion.(*Direct); ok {
+		return d.Exec(remote, cmd)
+	}
+	if client.Agent(remote) {
+		return client.AgentRemote(remote, "exec", "--", "sh", "-c", ShellQuote(cmd))
+	}
+	return client.pipeRemote(remote, func(h1, p1, h2, p2 string) (string, error) {
+		return client.RelayCmd(remote, h1, p1, cmd, h2, p2)
+	})
+}
+
+// pipeRemote allocates two data channels, and runs the command line
+// built by line with them on remote.
+func (client *SSHClient) pipeRemote(remote string, line func(h1, p1, h2, p2 string) (string, error)) (*RemoteConn, error) {
+	ssh, err := client.Session(remote)
+	if err != nil {
+		return nil, err
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			ssh.Stdin.Close()
+			ssh.Close()
+		}
+	}()
+
+	c1, h1, p1, err := AllocProxy()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if !ok {
+			c1.Close()
+		}
+	}()
+	c2, h2, p2, err := AllocProxy()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if !ok {
+			c2.Close()
+		}
+	}()
+
+	cmd, err := line(h1, p1, h2, p2)
+	if err != nil {
+		return nil, err
+	}
+	err = ssh.Start(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	ok = true
+	return &RemoteConn{
+		ssh: ssh,
+		c1:  c1,
+		c2:  c2,
+		w:   NewRC4Writer(c1, p1),
+		r:   NewRC4Reader(c2, p2),
+	}, nil
+}
+
+func (rc *RemoteConn) Read(p []byte) (int, error) {
+	return rc.r.Read(p)
+}
+
+func (rc *RemoteConn) Write(p []byte) (int, error) {
+	return rc.w.Write(p)
+}
+
+// CloseWrite closes CHANNEL1, then the remote sees EOF.
+func (rc *RemoteConn) CloseWrite() error {
+	return rc.c1.Close()
+}
+
+func (rc *RemoteConn) Close() error {
+	rc.c1.Close()
+	rc.c2.Close()
+	rc.ssh.Stdin.Close()
+	return rc.ssh.Close()
+}
+
+func (rc *RemoteConn) LocalAddr() net.Addr  { return rc.c1.LocalAddr() }
+func (rc *RemoteConn) RemoteAddr() net.Addr { return rc.c2.RemoteAddr() }
+
+func (rc *RemoteConn) SetDeadline(t time.Time) error {
+	rc.c1.SetWriteDeadline(t)
+	return rc.c2.SetReadDeadline(t)
+}
+
+func (rc *RemoteConn) SetReadDeadline(t time.Time) error  { return rc.c2.SetReadDeadline(t) }
+func (rc *RemoteConn) SetWriteDeadline(t time.Time) error { return rc.c1.SetWriteDeadline(t) }
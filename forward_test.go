@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestIsForwardSpec(t *testing.T) {
+	tests := []struct {
+		arg  string
+		spec bool
+	}{
+		{"a:1", true},
+		{"[fd00::20]:80", true},
+		{"a:1@b", true},
+		{"a:1=8080", true},
+		{"unix:/tmp/x.sock=8080", true},
+		{"b", false},
+		{"b@root", false},
+		{"10.0.0.1", false},
+		{"fd00::20", false},
+		{"fd00::20@root", false},
+		{"hostA/hostB", false},
+		{"hostA/fd00::20", false},
+	}
+	for _, tt := range tests {
+		if spec := isForwardSpec(tt.arg); spec != tt.spec {
+			t.Errorf("isForwardSpec(%q) = %v, want %v", tt.arg, spec, tt.spec)
+		}
+	}
+}
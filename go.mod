@@ -5,12 +5,12 @@ go 1.24.13
 require (
 	github.com/eachain/flagrouter v1.4.0
 	github.com/fatih/color v1.18.0
+	github.com/mattn/go-isatty v0.0.20
 	golang.org/x/crypto v0.47.0
 )
 
 require (
 	github.com/eachain/flags v1.4.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
-	github.com/mattn/go-isatty v0.0.20 // indirect
 	golang.org/x/sys v0.40.0 // indirect
 )
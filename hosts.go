@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type HostsOptions struct {
+	Search  string `desc:"keyword of hostname, ip or comment, default lists all"`
+	JSON    bool   `long:"json" desc:"output json instead of a table"`
+	Refresh bool   `long:"refresh" desc:"list assets from jumper, ignore the cache"`
+	TTL     int64  `long:"ttl" dft:"3600" desc:"seconds the cached asset list is valid"`
+	Names   bool   `long:"names" desc:"output hostnames only from the cache, never log in jumper, for shell completion"`
+}
+
+// hostsCache is the asset lists of jumpers, saved in $HOME/.snc/hosts.json,
+// keyed by "user@jumper".
+type hostsCache map[string]*hostsEntry
+
+type hostsEntry struct {
+	Time   time.Time `json:"time"`
+	Assets []Asset   `json:"assets"`
+}
+
+func hostsCachePath() string {
+	home := getEnvHome()
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, ".snc", "hosts.json")
+}
+
+func hostsCacheKey() string {
+	return Options.User + "@" + Options.Jumper
+}
+
+// loadHostsCache loads the cache file, empty if not exists or broken.
+func loadHostsCache() hostsCache {
+	cache := make(hostsCache)
+	path := hostsCachePath()
+	if path == "" {
+		return cache
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		json.Unmarshal(data, &cache)
+	}
+	return cache
+}
+
+func (cache hostsCache) save() error {
+	path := hostsCachePath()
+	if path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// configAssets returns the hosts in config, the assets of direct profiles.
+func configAssets() []Asset {
+	assets := make([]Asset, 0, len(Conf.Hosts))
+	for host, hc := range Conf.Hosts {
+		a := Asset{Hostname: host}
+		if hc != nil {
+			a.Comment = hc.Comment
+		}
+		assets = append(assets, a)
+	}
+	slices.SortFunc(assets, func(a, b Asset) int { return strings.Compare(a.Hostname, b.Hostname) })
+	return assets
+}
+
+// Hosts lists the assets on jumper, from the cache if not expired,
+// or the hosts in config if the profile is direct.
+func Hosts(ctx context.Context, opts *HostsOptions) {
+	cache := loadHostsCache()
+	entry := cache[hostsCacheKey()]
+	direct := Options.profile != nil && Options.profile.Bastion == BastionDirect
+	if direct {
+		entry = &hostsEntry{Time: time.Now(), Assets: configAssets()}
+	}
+
+	if opts.Names {
+		if entry != nil {
+			for _, a := range entry.Assets {
+				fmt.Println(a.Hostname)
+			}
+		}
+		return
+	}
+
+	checkJumper(false)
+	if !direct && (entry == nil || opts.Refresh || time.Since(entry.Time) > time.Duration(opts.TTL)*time.Second) {
+		client, err := NewSSHClient()
+		if err != nil {
+			return
+		}
+		js, ok := client.bastion.(*JumpServer)
+		if !ok {
+			client.Close()
+			fmt.Fprintln(os.Stderr, "only jumpserver bastions have an asset list")
+			return
+		}
+		assets, err := js.ListAssets()
+		client.Close()
+		if err != nil {
+			return
+		}
+		for i := range assets {
+			assets[i].ID = "" // only an index of the listing
+		}
+		entry = &hostsEntry{Time: time.Now(), Assets: assets}
+		cache[hostsCacheKey()] = entry
+		if err = cache.save(); err != nil {
+			fmt.Fprintf(os.Stderr, "save hosts cache: %v\n", err)
+		}
+	}
+
+	assets := entry.Assets
+	if opts.Search != "" {
+		assets = nil
+		keyword := strings.ToLower(opts.Search)
+		for _, a := range entry.Assets {
+			if strings.Contains(strings.ToLower(a.Hostname), keyword) ||
+				strings.Contains(a.IP, keyword) ||
+				strings.Contains(strings.ToLower(a.Comment), keyword) {
+				assets = append(assets, a)
+			}
+		}
+	}
+
+	if opts.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if assets == nil {
+			assets = []Asset{}
+		}
+		enc.Encode(assets)
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOSTNAME\tIP\tPLATFORM\tCOMMENT")
+	for _, a := range assets {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", a.Hostname, a.IP, a.Platform, a.Comment)
+	}
+	tw.Flush()
+}
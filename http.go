@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type HTTPOptions struct {
+	Remote   string   `required:"true" desc:"the remote host name or ip forward via"`
+	Listen   string   `short:"l" long:"listen" dft:"8080" desc:"local http listen address"`
+	Maps     []string `short:"m" long:"map" desc:"reverse proxy 'vhost=upstream' or '/path=upstream', upstream format: '[http(s)://]host:port[/path]'"`
+	Insecure bool     `short:"k" long:"insecure" desc:"skip verifying https upstream certificates"`
+}
+
+// httpRoute maps a virtual host or a path prefix to an upstream.
+type httpRoute struct {
+	vhost    string
+	prefix   string
+	upstream *url.URL
+}
+
+// HTTPProxy runs a local http proxy with CONNECT support, and reverse
+// proxies by virtual host or path prefix, all via the remote host,
+// so that one local port serves many internal sites.
+func HTTPProxy(ctx context.Context, opts *HTTPOptions) {
+	if opts.Remote == "" {
+		fmt.Fprintln(os.Stderr, "remote host is empty")
+		return
+	}
+	routes, err := parseHTTPRoutes(opts.Maps)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	opts.Listen = ListenAddr(opts.Listen)
+
+	client, err := NewSSHClient()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	listener, err := net.Listen(Network("tcp"), opts.Listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "local listen %q: %v\n", opts.Listen, err)
+		return
+	}
+	defer listener.Close()
+
+	fmt.Printf("http proxy listen on %v\n", listener.Addr())
+	for _, route := range routes {
+		if route.vhost != "" {
+			fmt.Printf("  http://%v -> %v\n", net.JoinHostPort(route.vhost, portOf(listener.Addr())), route.upstream)
+		} else {
+			fmt.Printf("  http://%v%v -> %v\n", listener.Addr(), route.prefix, route.upstream)
+		}
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			if err = CheckDialAddr(host, port); err != nil {
+				return nil, err
+			}
+			return client.DialRemote(opts.Remote, host, port)
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: opts.Insecure},
+		// each idle conn holds a jumper session or nc pipeline
+		MaxIdleConnsPerHost: 1,
+		IdleConnTimeout:     30 * time.Second,
+	}
+	proxy := &httpProxy{
+		client:    client,
+		remote:    opts.Remote,
+		routes:    routes,
+		transport: transport,
+	}
+
+	err = http.Serve(listener, proxy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "serve http: %v\n", err)
+	}
+}
+
+func portOf(addr net.Addr) string {
+	_, port, _ := net.SplitHostPort(addr.String())
+	return port
+}
+
+func parseHTTPRoutes(maps []string) ([]*httpRoute, error) {
+	routes := make([]*httpRoute, 0, len(maps))
+	for _, m := range maps {
+		from, to, ok := strings.Cut(m, "=")
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid map %q, format: 'vhost=upstream' or '/path=upstream'", m)
+		}
+		if !strings.Contains(to, "://") {
+			to = "http://" + to
+		}
+		upstream, err := url.Parse(to)
+		if err != nil || upstream.Host == "" {
+			return nil, fmt.Errorf("invalid upstream %q in map %q", to, m)
+		}
+
+		route := &httpRoute{upstream: upstream}
+		if strings.HasPrefix(from, "/") {
+			route.prefix = strings.TrimSuffix(from, "/")
+		} else {
+			route.vhost = strings.ToLower(from)
+		}
+		routes = append(routes, route)
+	}
+	// longest path prefix first
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].prefix) > len(routes[j].prefix)
+	})
+	return routes, nil
+}
+
+type httpProxy struct {
+	client    *SSHClient
+	remote    string
+	routes    []*httpRoute
+	transport *http.Transport
+}
+
+func (hp *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if Options.Debug {
+		fmt.Printf("http %v %v %v\n", r.Method, r.Host, r.RequestURI)
+	}
+
+	if r.Method == http.MethodConnect {
+		hp.connect(w, r)
+		return
+	}
+
+	if r.URL.IsAbs() { // forward proxy request
+		rp := &httputil.ReverseProxy{
+			Rewrite:   func(*httputil.ProxyRequest) {}, // the absolute url is kept as is
+			Transport: hp.transport,
+		}
+		rp.ServeHTTP(w, r)
+		return
+	}
+
+	route, path := hp.match(r)
+	if route == nil {
+		http.Error(w, fmt.Sprintf("no upstream for %v%v", r.Host, r.URL.Path), http.StatusNotFound)
+		return
+	}
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Path = path
+			pr.Out.URL.RawPath = ""
+			pr.SetURL(route.upstream) // rewrites Host header to the upstream too
+			pr.SetXForwarded()
+		},
+		Transport: hp.transport,
+	}
+	rp.ServeHTTP(w, r)
+}
+
+// match finds the route by virtual host first, then by path prefix,
+// and returns the path with the prefix stripped.
+func (hp *httpProxy) match(r *http.Request) (*httpRoute, string) {
+	host, _ := SplitHostPort(r.Host, "")
+	host = strings.ToLower(host)
+	for _, route := range hp.routes {
+		if route.vhost != "" && route.vhost == host {
+			return route, r.URL.Path
+		}
+	}
+	for _, route := range hp.routes {
+		if route.prefix == "" {
+			continue
+		}
+		if r.URL.Path == route.prefix || strings.HasPrefix(r.URL.Path, route.prefix+"/") {
+			path := strings.TrimPrefix(r.URL.Path, route.prefix)
+			if path == "" {
+				path = "/"
+			}
+			return route, path
+		}
+	}
+	return nil, ""
+}
+
+func (hp *httpProxy) connect(w http.ResponseWriter, r *http.Request) {
+	host, port, err := net.SplitHostPort(r.Host)
+	if err == nil {
+		err = CheckDialAddr(host, port)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijack unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	rc, err := hp.client.DialRemote(hp.remote, host, port)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer rc.Close()
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "http hijack: %v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if err != nil {
+		return
+	}
+	if n := brw.Reader.Buffered(); n > 0 { // data sent before our reply
+		data, _ := brw.Reader.Peek(n)
+		if _, err = rc.Write(data); err != nil {
+			return
+		}
+	}
+	Pipe(conn, rc)
+}
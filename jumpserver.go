@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/mattn/go-isatty"
+	"golang.org/x/crypto/ssh"
+)
+
+// JumpServer is the bastion with the KoKo menu: type the host at '>',
+// and it logs in the host in the same pty.
+type JumpServer struct {
+	sc     *ssh.Client
+	assets assetCache
+}
+
+func (js *JumpServer) Close() error {
+	return js.sc.Close()
+}
+
+func (js *JumpServer) Login(host string) (*SSHSession, error) {
+	ss, err := newSession(js.sc, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// wait input hostname
+	_, _, err = ss.exp.Expect("jumper menu", stepTimeout(), menuPrompt)
+	if err != nil {
+		ss.Close()
+		fmt.Fprintf(os.Stderr, "ssh: %v\n", err)
+		return nil, err
+	}
+
+	// input hostname
+	name, account := hostAccount(host)
+	fmt.Fprintf(ss.Stdin, "%v\r", name)
+	// whether connect to the host or any error
+	err = js.parseConnectHost(ss, name, account)
+	if err != nil {
+		ss.Close()
+		fmt.Fprintf(os.Stderr, "ssh connect to %q: %v\n", host, err)
+		return nil, err
+	}
+	return ss, nil
+}
+
+// Prompts count only when they end the output buffered so far, so that
+// '$', '#', '%' or '>' in banners and list comments are not taken as them.
+// Colors may follow the prompt.
+var (
+	shellPrompt = Regexp(`[$#%] *(\x1b\[[0-9;?]*[a-zA-Z])* *\z`)
+	menuPrompt  = Regexp(`> *(\x1b\[[0-9;?]*[a-zA-Z])* *\z`)
+)
+
+// parseConnectHost waits for the shell prompt of host, or jumper menu '>'
+// with the error message, the asset list or the account list before it.
+// Shell prompts are sh and bash '$', root '#' and zsh '%', and the exact
+// end of commands is the sentinel.
+func (js *JumpServer) parseConnectHost(ss *SSHSession, host, account string) error {
+	var asset, login bool // each list is answered once
+	var output []byte     // since the last answer
+	for {
+		i, out, err := ss.exp.Expect(fmt.Sprintf("login to %q", host), stepTimeout(),
+			shellPrompt, menuPrompt)
+		if err != nil {
+			return err
+		}
+		output = append(output, out...)
+
+		// a list is always followed by the menu, so a prompt character
+		// ending a read in the middle of a list is not the shell
+		assets := parseAssets(output)
+		accounts := parseAccounts(output)
+		if i == 0 && len(assets) == 0 && len(accounts) == 0 {
+			return nil
+		}
+		if i == 0 {
+			continue
+		}
+
+		var id string
+		if len(assets) > 0 && !asset {
+			asset = true
+			id, err = js.assets.chooseAsset(host, assets)
+		} else if len(accounts) > 0 && !login {
+			login = true
+			id, err = js.assets.chooseAccount(host, account, accounts)
+		} else {
+			lines := bytes.Split(output, []byte{'\n'})
+			return errors.New(string(bytes.TrimSpace(bytes.Join(lines[:len(lines)-1], []byte{'\n'}))))
+		}
+		if err != nil {
+			return err
+		}
+		output = nil
+		fmt.Fprintf(ss.Stdin, "%v\r", id)
+	}
+}
+
+// When the host typed at the jumper menu matches several assets,
+// JumpServer lists them and waits at the menu again:
+//
+//	  ID  | 主机名      | IP          | 平台   | 组织    | 备注
+//	+-----+-------------+-------------+--------+---------+------
+//	  1   | web-01      | 10.0.0.1    | Linux  | Default |
+//	  2   | web-01-bak  | 10.0.0.2    | Linux  | Default |
+//	页码：1，每页行数：20，总页数：1，总数量：2
+//
+// snc then types the ID of the asset whose hostname or ip is exactly
+// the host, or asks which one if it is ambiguous and there is a tty.
+
+// Asset is a row of the jumper asset list.
+type Asset struct {
+	ID       string `json:"id,omitempty"`
+	Hostname string `json:"hostname"`
+	IP       string `json:"ip"`
+	Platform string `json:"platform"`
+	Comment  string `json:"comment"`
+}
+
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;?]*[a-zA-Z]")
+
+// parseTable parses the first table in output, whose header starts
+// with "ID", and whose rows start with a number. It returns the header
+// in lower case, nil if there is no table.
+func parseTable(output []byte) (header []string, rows [][]string) {
+	output = ansiEscape.ReplaceAll(output, nil)
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.Trim(line, " \t\r|")
+		if !strings.Contains(line, "|") {
+			continue
+		}
+		cells := strings.Split(line, "|")
+		for i := range cells {
+			cells[i] = strings.TrimSpace(cells[i])
+		}
+		if header == nil {
+			if strings.EqualFold(cells[0], "id") {
+				header = cells
+				for i := range header {
+					header[i] = strings.ToLower(header[i])
+				}
+			}
+			continue
+		}
+		if isNumber(cells[0]) {
+			rows = append(rows, cells)
+		}
+	}
+	return
+}
+
+// column returns the cell of row under any of names, empty if none.
+func column(header, row []string, names ...string) string {
+	for i, h := range header {
+		if i < len(row) && slices.Contains(names, h) {
+			return row[i]
+		}
+	}
+	return ""
+}
+
+// parseAssets parses the asset list in output, nil if there is none.
+func parseAssets(output []byte) []Asset {
+	header, rows := parseTable(output)
+	if slices.ContainsFunc(header, isAccountColumn) {
+		return nil // the account list
+	}
+	var assets []Asset
+	for _, row := range rows {
+		assets = append(assets, Asset{
+			ID:       row[0],
+			Hostname: column(header, row, "主机名", "hostname", "名称", "name"),
+			IP:       column(header, row, "ip", "地址", "address"),
+			Platform: column(header, row, "平台", "platform"),
+			Comment:  column(header, row, "备注", "comment"),
+		})
+	}
+	return assets
+}
+
+func isNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// printAssets prints assets as a table.
+func printAssets(w io.Writer, assets []Asset) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tHOSTNAME\tIP\tPLATFORM\tCOMMENT")
+	for _, a := range assets {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", a.ID, a.Hostname, a.IP, a.Platform, a.Comment)
+	}
+	tw.Flush()
+}
+
+// Account is a row of the jumper account list of an asset,
+// shown after the asset if it has several system users.
+type Account struct {
+	ID       string
+	Name     string
+	Username string
+}
+
+func isAccountColumn(h string) bool {
+	return h == "用户名" || h == "username"
+}
+
+// parseAccounts parses the account list in output, nil if there is none.
+func parseAccounts(output []byte) []Account {
+	header, rows := parseTable(output)
+	if !slices.ContainsFunc(header, isAccountColumn) {
+		return nil
+	}
+	var accounts []Account
+	for _, row := range rows {
+		accounts = append(accounts, Account{
+			ID:       row[0],
+			Name:     column(header, row, "名称", "name"),
+			Username: column(header, row, "用户名", "username"),
+		})
+	}
+	return accounts
+}
+
+// hostAccount splits remote "host@account". The account defaults to
+// --account, then the account of host in config, empty if none.
+func hostAccount(remote string) (host, account string) {
+	host, account, _ = strings.Cut(remote, "@")
+	if account == "" {
+		account = Options.Account
+	}
+	if account == "" {
+		if hc := Conf.Hosts[host]; hc != nil {
+			account = hc.Account
+		}
+	}
+	return
+}
+
+// hopAccount splits "host@account" of hops after the first one, the
+// account defaults to the one in config, empty means the default of ssh.
+func hopAccount(hop string) (host, account string) {
+	host, account, _ = strings.Cut(hop, "@")
+	if hc := Conf.Hosts[host]; account == "" && hc != nil {
+		account = hc.Account
+	}
+	return
+}
+
+// assetCache remembers the assets and accounts chosen by hand for each
+// host, so that the user is asked once, though sessions are opened
+// concurrently.
+type assetCache struct {
+	mu       sync.Mutex
+	chosen   map[string]Asset
+	accounts map[string]string // host -> username
+}
+
+// chooseAsset returns the ID of the asset which host means.
+func (ac *assetCache) chooseAsset(host string, assets []Asset) (string, error) {
+	var exact []Asset
+	for _, a := range assets {
+		if a.Hostname == host || a.IP == host {
+			exact = append(exact, a)
+		}
+	}
+	if len(exact) == 1 {
+		return exact[0].ID, nil
+	}
+	if len(exact) > 1 {
+		assets = exact
+	}
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if c, ok := ac.chosen[host]; ok {
+		for _, a := range assets {
+			if a.Hostname == c.Hostname && a.IP == c.IP {
+				return a.ID, nil
+			}
+		}
+	}
+
+	var b bytes.Buffer
+	printAssets(&b, assets)
+	i, err := ask(fmt.Sprintf("%v assets match %q", len(assets), host),
+		"use an exact hostname or ip", b.Bytes(), len(assets), func(i int) string { return assets[i].ID })
+	if err != nil {
+		return "", err
+	}
+	if ac.chosen == nil {
+		ac.chosen = make(map[string]Asset)
+	}
+	ac.chosen[host] = assets[i]
+	return assets[i].ID, nil
+}
+
+// chooseAccount returns the ID of account of host, or asks for one
+// if account is empty.
+func (ac *assetCache) chooseAccount(host, account string, accounts []Account) (string, error) {
+	var b bytes.Buffer
+	tw := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tUSERNAME")
+	for _, a := range accounts {
+		fmt.Fprintf(tw, "%v\t%v\t%v\n", a.ID, a.Name, a.Username)
+	}
+	tw.Flush()
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if account == "" {
+		account = ac.accounts[host]
+	}
+	if account != "" {
+		for _, a := range accounts {
+			if a.Username == account || a.Name == account {
+				return a.ID, nil
+			}
+		}
+		return "", fmt.Errorf("no account %q on %q:\n%s", account, host, bytes.TrimSpace(b.Bytes()))
+	}
+
+	i, err := ask(fmt.Sprintf("%q has %v accounts", host, len(accounts)),
+		"use --account or 'host@account'", b.Bytes(), len(accounts), func(i int) string { return accounts[i].ID })
+	if err != nil {
+		return "", err
+	}
+	if ac.accounts == nil {
+		ac.accounts = make(map[string]string)
+	}
+	ac.accounts[host] = accounts[i].Username
+	return accounts[i].ID, nil
+}
+
+// ask shows table of n choices, and returns the index of the one selected
+// on the tty. Without a tty, it returns an error with the hint and table.
+func ask(title, hint string, table []byte, n int, id func(int) string) (int, error) {
+	if !isatty.IsTerminal(os.Stdin.Fd()) || !isatty.IsTerminal(os.Stderr.Fd()) {
+		return -1, fmt.Errorf("%v, %v:\n%s", title, hint, bytes.TrimSpace(table))
+	}
+
+	fmt.Fprintf(os.Stderr, "%v:\n%s", title, table)
+	br := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Fprint(os.Stderr, "select ID: ")
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return -1, errors.New("nothing selected")
+		}
+		line = strings.TrimSpace(line)
+		for i := 0; i < n; i++ {
+			if id(i) == line {
+				return i, nil
+			}
+		}
+	}
+}
+
+// pageInfo matches the page line under the asset list of all versions.
+var pageInfo = regexp.MustCompile(`(?i)(?:页码|page)\s*[：:]\s*(\d+).*?(?:总页数|total\s*page)\s*[：:]\s*(\d+)`)
+
+// ListAssets lists all assets on jumper by its menu, page by page.
+func (js *JumpServer) ListAssets() ([]Asset, error) {
+	ss, err := newSession(js.sc, "")
+	if err != nil {
+		return nil, err
+	}
+	defer ss.Close()
+	return ss.listAssets()
+}
+
+func (ss *SSHSession) listAssets() ([]Asset, error) {
+	_, _, err := ss.exp.Expect("jumper menu", stepTimeout(), menuPrompt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ssh: %v\n", err)
+		return nil, err
+	}
+
+	var assets []Asset
+	cmd, last := "p", ""
+	for {
+		fmt.Fprintf(ss.Stdin, "%v\r", cmd)
+		_, output, err := ss.exp.Expect("asset list", stepTimeout(), menuPrompt)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ssh: %v\n", err)
+			return nil, err
+		}
+		assets = append(assets, parseAssets(output)...)
+
+		m := pageInfo.FindSubmatch(ansiEscape.ReplaceAll(output, nil))
+		if m == nil || string(m[1]) == last {
+			break
+		}
+		page, _ := strconv.Atoi(string(m[1]))
+		total, _ := strconv.Atoi(string(m[2]))
+		if page >= total {
+			break
+		}
+		cmd, last = "n", string(m[1])
+	}
+	return assets, nil
+}
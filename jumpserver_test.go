@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Menu output in the KoKo format, after typing a hostname or "p".
+const (
+	koKoAssets = "web\r\n" +
+		"  ID  | 主机名            | IP           | 平台   | 组织    | 备注          \r\n" +
+		"+-----+-------------------+--------------+--------+---------+---------------+\r\n" +
+		"  1   | web-01            | 10.0.0.1     | Linux  | Default | 前端#1 90%    \r\n" +
+		"  2   | web-01-bak        | 10.0.0.2     | Linux  | Default |               \r\n" +
+		"  3   | 网关-上海         | 10.0.1.1     | Linux  | 运维    | $HOME> 备用   \r\n" +
+		"页码：1，每页行数：3，总页数：2，总数量：5\r\n" +
+		"提示：输入资产ID直接登录，二级搜索使用 // + 字段，如：//192 上一页：b 下一页：n\r\n" +
+		"搜索：web\r\n" +
+		"[Host]> "
+
+	koKoAssetsColor = "\x1b[32m  ID  \x1b[0m| \x1b[32mHostname\x1b[0m | \x1b[32mIP\x1b[0m       | Platform | Comment\r\n" +
+		"+------+----------+----------+----------+--------+\r\n" +
+		"  4   | db-01    | 10.0.2.1 | Linux    |\r\n" +
+		"  5   | db-02    | 10.0.2.2 | Windows  | ad\r\n" +
+		"Page: 2, Page size: 3, Total page: 2, Total: 5\r\n" +
+		"Opt> "
+
+	koKoEmpty = "nothing\r\n" +
+		"  ID  | 主机名  | IP  | 平台  | 组织  | 备注  \r\n" +
+		"+-----+---------+-----+-------+-------+-------+\r\n" +
+		"页码：1，每页行数：20，总页数：0，总数量：0\r\n" +
+		"[Host]> "
+
+	koKoNotFound = "nothing\r\n" +
+		"没有找到资产\r\n" +
+		"[Host]> "
+
+	koKoAccounts = "  ID  | 名称      | 用户名   \r\n" +
+		"+-----+-----------+----------+\r\n" +
+		"  1   | 运维账号  | ops      \r\n" +
+		"  2   | root      | root     \r\n" +
+		"ID> "
+)
+
+func TestParseAssets(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		assets []Asset
+	}{
+		{"cjk columns", koKoAssets, []Asset{
+			{ID: "1", Hostname: "web-01", IP: "10.0.0.1", Platform: "Linux", Comment: "前端#1 90%"},
+			{ID: "2", Hostname: "web-01-bak", IP: "10.0.0.2", Platform: "Linux"},
+			{ID: "3", Hostname: "网关-上海", IP: "10.0.1.1", Platform: "Linux", Comment: "$HOME> 备用"},
+		}},
+		{"english header with colors and a short row", koKoAssetsColor, []Asset{
+			{ID: "4", Hostname: "db-01", IP: "10.0.2.1", Platform: "Linux"},
+			{ID: "5", Hostname: "db-02", IP: "10.0.2.2", Platform: "Windows", Comment: "ad"},
+		}},
+		{"empty result", koKoEmpty, nil},
+		{"not found", koKoNotFound, nil},
+		{"account list", koKoAccounts, nil},
+	}
+	for _, tt := range tests {
+		if assets := parseAssets([]byte(tt.output)); !reflect.DeepEqual(assets, tt.assets) {
+			t.Errorf("%v: parseAssets = %+v, want %+v", tt.name, assets, tt.assets)
+		}
+	}
+}
+
+func TestParseAccounts(t *testing.T) {
+	want := []Account{
+		{ID: "1", Name: "运维账号", Username: "ops"},
+		{ID: "2", Name: "root", Username: "root"},
+	}
+	if accounts := parseAccounts([]byte(koKoAccounts)); !reflect.DeepEqual(accounts, want) {
+		t.Errorf("parseAccounts = %+v, want %+v", accounts, want)
+	}
+	for _, output := range []string{koKoAssets, koKoEmpty, koKoNotFound} {
+		if accounts := parseAccounts([]byte(output)); accounts != nil {
+			t.Errorf("parseAccounts of an asset list = %+v, want nil", accounts)
+		}
+	}
+}
+
+func TestPageInfo(t *testing.T) {
+	tests := []struct {
+		output      string
+		page, total string
+	}{
+		{koKoAssets, "1", "2"},
+		{koKoAssetsColor, "2", "2"},
+		{koKoEmpty, "1", "0"},
+		{koKoNotFound, "", ""},
+	}
+	for _, tt := range tests {
+		var page, total string
+		if m := pageInfo.FindStringSubmatch(tt.output); m != nil {
+			page, total = m[1], m[2]
+		}
+		if page != tt.page || total != tt.total {
+			t.Errorf("page info of %q = %q/%q, want %q/%q", tt.output, page, total, tt.page, tt.total)
+		}
+	}
+}
+
+func TestPrompts(t *testing.T) {
+	tests := []struct {
+		output      string
+		shell, menu bool
+	}{
+		{"[root@web-01 ~]# ", true, false},
+		{"user@web-01:~$ ", true, false},
+		{"web-01% \x1b[0m", true, false},
+		{"[Host]> ", false, true},
+		{"Opt> ", false, true},
+		// prompt characters inside a list are not prompts
+		{koKoAssets[:len(koKoAssets)-len("[Host]> ")], false, false},
+		// a read ending inside a list looks like one,
+		// where parseConnectHost finds the list first
+		{"  1   | web-01 | 10.0.0.1 | Linux | Default | 90%", true, false},
+		{"  1   | web-01 | 10.0.0.1 | Linux | Default | #ops\r\n", false, false},
+	}
+	for _, tt := range tests {
+		shell := shellPrompt.find([]byte(tt.output)) != nil
+		menu := menuPrompt.find([]byte(tt.output)) != nil
+		if shell != tt.shell || menu != tt.menu {
+			t.Errorf("prompts of %q: shell %v, menu %v, want %v, %v", tt.output, shell, menu, tt.shell, tt.menu)
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// A tiny stream multiplexer, like yamux/smux, carrying many logical streams
+// over one byte stream: the data channel pair to the remote relay.
+// It is shared by snc and sncagent, so it must not depend on Options.
+//
+// Frame: cmd(1) | stream id(4) | payload length(2) | payload.
+// Only the client opens streams, the SYN payload is the target address,
+// "host:port" or "unix:/path", and the server replies an empty SYN once
+// connected, or RST with the error message. The client is snc for tunnels,
+// and sncagent for reverse forwards, where the target is the remote peer. Each stream has a receive window,
+// the sender stops when the window is used up, until ACKed.
+
+const (
+	muxSYN  = 1 // open stream, payload is the target address; empty reply means connected
+	muxDATA = 2 // stream data
+	muxFIN  = 3 // half close, the sender sends no more data
+	muxRST  = 4 // abort stream, payload is the error message
+	muxACK  = 5 // window update, payload is 4 bytes consumed count
+
+	muxHeaderSize = 7
+	muxMaxPayload = 32 * 1024
+	muxWindow     = 256 * 1024
+)
+
+var (
+	ErrMuxClosed = errors.New("mux session closed")
+	ErrMuxReset  = errors.New("mux stream reset")
+)
+
+type MuxSession struct {
+	r      io.Reader
+	w      io.Writer
+	closer io.Closer
+
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*MuxStream
+	nextID  uint32
+	accepts chan *MuxStream
+
+	once   sync.Once
+	closed chan struct{}
+	err    error
+}
+
+// NewMuxSession starts a mux session over r and w, closer is closed
+// with the session if not nil. The client opens streams, the server accepts.
+func NewMuxSession(r io.Reader, w io.Writer, closer io.Closer, client bool) *MuxSession {
+	s := &MuxSession{
+		r:       r,
+		w:       w,
+		closer:  closer,
+		streams: make(map[uint32]*MuxStream),
+		closed:  make(chan struct{}),
+	}
+	if client {
+		s.nextID = 1
+	} else {
+		s.accepts = make(chan *MuxStream, 64)
+	}
+	go s.recvLoop()
+	return s
+}
+
+func (s *MuxSession) writeFrame(cmd byte, id uint32, payload []byte) error {
+	var hdr [muxHeaderSize]byte
+	hdr[0] = cmd
+	binary.BigEndian.PutUint32(hdr[1:], id)
+	binary.BigEndian.PutUint16(hdr[5:], uint16(len(payload)))
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	select {
+	case <-s.closed:
+		return ErrMuxClosed
+	default:
+	}
+	// one write per frame, so that frames never interleave
+	_, err := s.w.Write(append(hdr[:], payload...))
+	if err != nil {
+		s.closeWithError(err)
+	}
+	return err
+}
+
+// Open opens a new stream to target, and waits until the server connected it.
+func (s *MuxSession) Open(target string) (*MuxStream, error) {
+	if len(target) > muxMaxPayload {
+		return nil, errors.New("mux target too long")
+	}
+	s.mu.Lock()
+	if s.IsClosed() {
+		s.mu.Unlock()
+		return nil, ErrMuxClosed
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newMuxStream(s, id, target)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(muxSYN, id, []byte(target)); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+
+	st.mu.Lock()
+	for !st.ready && st.err == nil {
+		st.cond.Wait()
+	}
+	err := st.err
+	st.mu.Unlock()
+	if err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for a new stream opened by the client.
+func (s *MuxSession) Accept() (*MuxStream, error) {
+	select {
+	case st := <-s.accepts:
+		return st, nil
+	case <-s.closed:
+		return nil, s.err
+	}
+}
+
+func (s *MuxSession) IsClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Done is closed when the session is closed.
+func (s *MuxSession) Done() <-chan struct{} {
+	return s.closed
+}
+
+func (s *MuxSession) Close() error {
+	s.closeWithError(ErrMuxClosed)
+	return nil
+}
+
+func (s *MuxSession) closeWithError(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.closed)
+		if s.closer != nil {
+			s.closer.Close()
+		}
+		s.mu.Lock()
+		streams := s.streams
+		s.streams = make(map[uint32]*MuxStream)
+		s.mu.Unlock()
+		for _, st := range streams {
+			st.reset(ErrMuxClosed)
+		}
+	})
+}
+
+func (s *MuxSession) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *MuxSession) recvLoop() {
+	var hdr [muxHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+			s.closeWithError(err)
+			return
+		}
+		cmd := hdr[0]
+		id := binary.BigEndian.Uint32(hdr[1:])
+		payload := make([]byte, binary.BigEndian.Uint16(hdr[5:]))
+		if _, err := io.ReadFull(s.r, payload); err != nil {
+			s.closeWithError(err)
+			return
+		}
+
+		if cmd == muxSYN {
+			if s.accepts == nil { // reply of Open
+				s.mu.Lock()
+				st := s.streams[id]
+				s.mu.Unlock()
+				if st != nil {
+					st.mu.Lock()
+					st.ready = true
+					st.mu.Unlock()
+					st.cond.Broadcast()
+				}
+				continue
+			}
+			st := newMuxStream(s, id, string(payload))
+			s.mu.Lock()
+			s.streams[id] = st
+			s.mu.Unlock()
+			select {
+			case s.accepts <- st:
+			case <-s.closed:
+				return
+			}
+			continue
+		}
+
+		s.mu.Lock()
+		st := s.streams[id]
+		s.mu.Unlock()
+		if st == nil {
+			if cmd == muxDATA {
+				s.writeFrame(muxRST, id, []byte("stream not found"))
+			}
+			continue
+		}
+
+		switch cmd {
+		case muxDATA:
+			st.push(payload)
+		case muxFIN:
+			st.pushEOF()
+		case muxRST:
+			msg := ErrMuxReset
+			if len(payload) > 0 {
+				msg = errors.New(string(payload))
+			}
+			st.reset(msg)
+			s.removeStream(id)
+		case muxACK:
+			if len(payload) == 4 {
+				st.ack(binary.BigEndian.Uint32(payload))
+			}
+		}
+	}
+}
+
+// MuxStream is a logical stream in a mux session.
+type MuxStream struct {
+	s      *MuxSession
+	id     uint32
+	target string
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     []byte
+	ready   bool  // connected by the server
+	eof     bool  // FIN received
+	err     error // reset or closed
+	sendWnd int
+	unacked int // consumed but not acked
+	wclosed bool
+}
+
+func newMuxStream(s *MuxSession, id uint32, target string) *MuxStream {
+	st := &MuxStream{s: s, id: id, target: target, sendWnd: muxWindow}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+// Target is the address the stream opened to.
+func (st *MuxStream) Target() string {
+	return st.target
+}
+
+func (st *MuxStream) push(p []byte) {
+	st.mu.Lock()
+	st.buf = append(st.buf, p...)
+	st.mu.Unlock()
+	st.cond.Broadcast()
+}
+
+func (st *MuxStream) pushEOF() {
+	st.mu.Lock()
+	st.eof = true
+	done := st.wclosed
+	st.mu.Unlock()
+	st.cond.Broadcast()
+	if done {
+		st.s.removeStream(st.id)
+	}
+}
+
+func (st *MuxStream) ack(n uint32) {
+	st.mu.Lock()
+	st.sendWnd += int(n)
+	st.mu.Unlock()
+	st.cond.Broadcast()
+}
+
+func (st *MuxStream) reset(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.mu.Unlock()
+	st.cond.Broadcast()
+}
+
+func (st *MuxStream) Read(p []byte) (int, error) {
+	st.mu.Lock()
+	for len(st.buf) == 0 && !st.eof && st.err == nil {
+		st.cond.Wait()
+	}
+	if len(st.buf) == 0 {
+		defer st.mu.Unlock()
+		if st.err != nil {
+			return 0, st.err
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, st.buf)
+	st.buf = st.buf[n:]
+	if len(st.buf) == 0 {
+		st.buf = nil
+	}
+	st.unacked += n
+	var ack uint32
+	if st.unacked >= muxWindow/4 || len(st.buf) == 0 {
+		ack = uint32(st.unacked)
+		st.unacked = 0
+	}
+	st.mu.Unlock()
+
+	if ack > 0 {
+		st.s.writeFrame(muxACK, st.id, binary.BigEndian.AppendUint32(nil, ack))
+	}
+	return n, nil
+}
+
+func (st *MuxStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		st.mu.Lock()
+		for st.sendWnd <= 0 && st.err == nil && !st.wclosed {
+			st.cond.Wait()
+		}
+		if st.err != nil || st.wclosed {
+			err := st.err
+			st.mu.Unlock()
+			if err == nil {
+				err = net.ErrClosed
+			}
+			return written, err
+		}
+		n := min(len(p), st.sendWnd, muxMaxPayload)
+		st.sendWnd -= n
+		st.mu.Unlock()
+
+		if err := st.s.writeFrame(muxDATA, st.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite sends FIN, the peer reads io.EOF.
+func (st *MuxStream) CloseWrite() error {
+	st.mu.Lock()
+	if st.wclosed || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.wclosed = true
+	done := st.eof
+	st.mu.Unlock()
+	st.cond.Broadcast()
+
+	err := st.s.writeFrame(muxFIN, st.id, nil)
+	if done {
+		st.s.removeStream(st.id)
+	}
+	return err
+}
+
+// Accept tells the client that the stream is connected, server only.
+func (st *MuxStream) Accept() error {
+	return st.s.writeFrame(muxSYN, st.id, nil)
+}
+
+// Reset aborts the stream with an error message for the peer.
+func (st *MuxStream) Reset(msg string) error {
+	st.reset(ErrMuxReset)
+	st.s.removeStream(st.id)
+	return st.s.writeFrame(muxRST, st.id, []byte(msg))
+}
+
+// Close closes the stream: graceful if both sides are done, else reset.
+func (st *MuxStream) Close() error {
+	st.mu.Lock()
+	graceful := st.eof && len(st.buf) == 0
+	st.mu.Unlock()
+	if graceful {
+		err := st.CloseWrite()
+		st.reset(net.ErrClosed)
+		return err
+	}
+	return st.Reset("closed")
+}
+
+type muxAddr string
+
+func (a muxAddr) Network() string { return "mux" }
+func (a muxAddr) String() string  { return string(a) }
+
+func (st *MuxStream) LocalAddr() net.Addr  { return muxAddr("mux") }
+func (st *MuxStream) RemoteAddr() net.Addr { return muxAddr(st.target) }
+
+// Deadlines are not supported.
+func (st *MuxStream) SetDeadline(t time.Time) error      { return nil }
+func (st *MuxStream) SetReadDeadline(t time.Time) error  { return nil }
+func (st *MuxStream) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// muxPair returns a client and a server session connected by net.Pipe.
+func muxPair(t *testing.T) (client, server *MuxSession) {
+	c1, c2 := net.Pipe()
+	client = NewMuxSession(c1, c1, c1, true)
+	server = NewMuxSession(c2, c2, c2, false)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return
+}
+
+// wait fails the test if done is not closed in time, since a broken
+// window or close would hang instead of failing.
+func wait(t *testing.T, what string, done <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for %v", what)
+	}
+}
+
+// acceptEcho accepts one stream and echoes it until EOF.
+func acceptEcho(t *testing.T, server *MuxSession, target string) {
+	go func() {
+		st, err := server.Accept()
+		if err != nil {
+			t.Errorf("accept: %v", err)
+			return
+		}
+		if st.Target() != target {
+			t.Errorf("target = %q, want %q", st.Target(), target)
+		}
+		st.Accept()
+		io.Copy(st, st)
+		st.CloseWrite()
+	}()
+}
+
+func TestMuxOpenAccept(t *testing.T) {
+	client, server := muxPair(t)
+	acceptEcho(t, server, "example.com:80")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		st, err := client.Open("example.com:80")
+		if err != nil {
+			t.Errorf("open: %v", err)
+			return
+		}
+		st.Write([]byte("hello"))
+		st.CloseWrite()
+		data, err := io.ReadAll(st)
+		if err != nil || string(data) != "hello" {
+			t.Errorf("read %q, %v, want hello", data, err)
+		}
+	}()
+	wait(t, "echo", done)
+}
+
+func TestMuxWindow(t *testing.T) {
+	client, server := muxPair(t)
+	acceptEcho(t, server, "big")
+
+	data := make([]byte, 4*muxWindow+12345)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		st, err := client.Open("big")
+		if err != nil {
+			t.Errorf("open: %v", err)
+			return
+		}
+		go func() {
+			// more than the window, blocks forever without ACKs
+			if _, err := st.Write(data); err != nil {
+				t.Errorf("write: %v", err)
+			}
+			st.CloseWrite()
+		}()
+		got, err := io.ReadAll(st)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("read %v bytes, %v, want %v bytes equal", len(got), err, len(data))
+		}
+	}()
+	wait(t, "transfer", done)
+}
+
+func TestMuxHalfClose(t *testing.T) {
+	client, server := muxPair(t)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		st, err := server.Accept()
+		if err != nil {
+			t.Errorf("accept: %v", err)
+			return
+		}
+		st.Accept()
+		data, err := io.ReadAll(st)
+		if err != nil || string(data) != "request" {
+			t.Errorf("server read %q, %v, want request", data, err)
+		}
+		// the client closed only its write side
+		if _, err = st.Write([]byte("response")); err != nil {
+			t.Errorf("server write after peer FIN: %v", err)
+		}
+		st.CloseWrite()
+	}()
+
+	st, err := client.Open("half")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	st.Write([]byte("request"))
+	st.CloseWrite()
+	if _, err = st.Write([]byte("x")); err == nil {
+		t.Errorf("write after CloseWrite succeeded")
+	}
+	data, err := io.ReadAll(st)
+	if err != nil || string(data) != "response" {
+		t.Errorf("client read %q, %v, want response", data, err)
+	}
+	wait(t, "server", done)
+}
+
+func TestMuxReset(t *testing.T) {
+	client, server := muxPair(t)
+
+	go func() {
+		st, err := server.Accept()
+		if err != nil {
+			return
+		}
+		st.Reset("connection refused")
+
+		st, err = server.Accept()
+		if err != nil {
+			return
+		}
+		st.Accept()
+		st.Reset("boom")
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := client.Open("refused")
+		if err == nil || err.Error() != "connection refused" {
+			t.Errorf("open refused: %v, want connection refused", err)
+		}
+
+		st, err := client.Open("reset")
+		if err != nil {
+			t.Errorf("open: %v", err)
+			return
+		}
+		_, err = io.ReadAll(st)
+		if err == nil || err.Error() != "boom" {
+			t.Errorf("read reset stream: %v, want boom", err)
+		}
+	}()
+	wait(t, "reset", done)
+}
+
+func TestMuxSessionClose(t *testing.T) {
+	client, server := muxPair(t)
+
+	go func() {
+		// accept both, but never read them
+		for {
+			st, err := server.Accept()
+			if err != nil {
+				return
+			}
+			st.Accept()
+		}
+	}()
+
+	reader, err := client.Open("reader")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	writer, err := client.Open("writer")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		if _, err := reader.Read(make([]byte, 1)); !errors.Is(err, ErrMuxClosed) {
+			t.Errorf("pending read: %v, want %v", err, ErrMuxClosed)
+		}
+	}()
+	writeDone := make(chan struct{})
+	go func() {
+		defer close(writeDone)
+		// blocks when the window is used up
+		if _, err := writer.Write(make([]byte, 2*muxWindow)); err == nil {
+			t.Errorf("pending write succeeded")
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	client.Close()
+	wait(t, "pending read", readDone)
+	wait(t, "pending write", writeDone)
+	if _, err = client.Open("after"); !errors.Is(err, ErrMuxClosed) {
+		t.Errorf("open after close: %v, want %v", err, ErrMuxClosed)
+	}
+
+	acceptDone := make(chan struct{})
+	go func() {
+		defer close(acceptDone)
+		server.Accept()
+	}()
+	wait(t, "server accept after peer closed", acceptDone)
+}
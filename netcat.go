@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// NCFlavor is the netcat implementation on a remote host. They differ:
+// only ncat has --recv-only/--send-only, and -w of OpenBSD netcat is
+// an idle timeout, which kills quiet database connections.
+type NCFlavor string
+
+const (
+	NCNcat        NCFlavor = "ncat"
+	NCOpenBSD     NCFlavor = "openbsd"
+	NCTraditional NCFlavor = "traditional"
+	NCBusybox     NCFlavor = "busybox"
+	NCNone        NCFlavor = "none" // bash /dev/tcp instead
+)
+
+type ncCache struct {
+	mu     sync.Mutex
+	remote map[string]NCFlavor
+	probes map[string]*ncProbing // remote -> probe in progress
+}
+
+// ncProbing is a probe in progress, which the others of the same remote
+// wait for, while other remotes are probed in parallel.
+type ncProbing struct {
+	done chan struct{}
+	f    NCFlavor
+}
+
+const ncProbe = `command -v nc >/dev/null || echo none; ` +
+	`{ nc --version; nc -h; } 2>&1 | head -3`
+
+// NC returns the nc flavor of remote, probed once per remote host.
+func (client *SSHClient) NC(remote string) NCFlavor {
+	nc := &client.ncs
+	nc.mu.Lock()
+	if f, ok := nc.remote[remote]; ok {
+		nc.mu.Unlock()
+		return f
+	}
+	if p := nc.probes[remote]; p != nil {
+		nc.mu.Unlock()
+		<-p.done
+		return p.f
+	}
+	p := &ncProbing{done: make(chan struct{})}
+	if nc.probes == nil {
+		nc.probes = make(map[string]*ncProbing)
+	}
+	nc.probes[remote] = p
+	nc.mu.Unlock()
+
+	// if the probe fails, try ncat, the error will show up later,
+	// and probe again next time
+	out, err := client.probeNC(remote)
+	p.f = NCNcat
+	if err == nil {
+		p.f = parseNCFlavor(out)
+		if Options.Debug {
+			fmt.Printf("nc on %q: %v\n", remote, p.f)
+		}
+	}
+
+	nc.mu.Lock()
+	delete(nc.probes, remote)
+	if err == nil {
+		if nc.remote == nil {
+			nc.remote = make(map[string]NCFlavor)
+		}
+		nc.remote[remote] = p.f
+	}
+	nc.mu.Unlock()
+	close(p.done)
+	return p.f
+}
+
+func (client *SSHClient) probeNC(remote string) (string, error) {
+	ss, err := client.Session(remote)
+	if err != nil {
+		return "", err
+	}
+	defer closeSession(ss)
+	out, _, err := ss.Output(ncProbe)
+	return out, err
+}
+
+func parseNCFlavor(out string) NCFlavor {
+	switch {
+	case strings.HasPrefix(out, "none"):
+		return NCNone
+	case strings.Contains(out, "Ncat"):
+		return NCNcat
+	case strings.Contains(out, "BusyBox"):
+		return NCBusybox
+	case strings.Contains(out, "OpenBSD"), strings.Contains(out, "[-46"):
+		return NCOpenBSD
+	}
+	return NCTraditional
+}
+
+// The commands below quote host, port and path, which may come from
+// socks or http clients, and end options by "--" in case of a host
+// starting with '-', which CheckDialHost refuses before.
+
+func devTCP(host, port string) string {
+	return "/dev/tcp/" + ShellQuote(host) + "/" + ShellQuote(port)
+}
+
+func bashC(script string) string {
+	return "bash -c " + ShellQuote(script)
+}
+
+// Recv reads data channel host:port, and writes to stdout.
+func (f NCFlavor) Recv(host, port string) string {
+	if f == NCNone {
+		return bashC("cat <" + devTCP(host, port))
+	}
+	host, port = ShellQuote(host), ShellQuote(port)
+	switch f {
+	case NCNcat:
+		return fmt.Sprintf("nc %v --recv-only -- %v %v", NCOptions(), host, port)
+	case NCOpenBSD:
+		return fmt.Sprintf("nc %v-d -- %v %v", NCFamily(), host, port)
+	}
+	return fmt.Sprintf("nc -- %v %v </dev/null", host, port)
+}
+
+// Send reads stdin, and writes to data channel host:port.
+func (f NCFlavor) Send(host, port string) string {
+	if f == NCNone {
+		return bashC("cat >" + devTCP(host, port))
+	}
+	host, port = ShellQuote(host), ShellQuote(port)
+	switch f {
+	case NCNcat:
+		return fmt.Sprintf("nc %v --send-only -- %v %v", NCOptions(), host, port)
+	case NCOpenBSD:
+		return fmt.Sprintf("nc %v-N -- %v %v", NCFamily(), host, port)
+	case NCTraditional:
+		return fmt.Sprintf("nc -q 0 -- %v %v", host, port)
+	}
+	return fmt.Sprintf("nc -- %v %v", host, port)
+}
+
+// Connect connects host:port, with stdin and stdout.
+// It has no -w except ncat, where -w is only the connect timeout.
+func (f NCFlavor) Connect(host, port string) string {
+	if f == NCNone {
+		return bashC("exec 3<>" + devTCP(host, port) + "; cat <&3 & cat >&3; wait")
+	}
+	host, port = ShellQuote(host), ShellQuote(port)
+	switch f {
+	case NCNcat:
+		return fmt.Sprintf("nc %v -- %v %v", NCOptions(), host, port)
+	case NCOpenBSD:
+		return fmt.Sprintf("nc %v-N -- %v %v", NCFamily(), host, port)
+	}
+	return fmt.Sprintf("nc -- %v %v", host, port)
+}
+
+// ConnectUnix connects unix socket path, with stdin and stdout.
+func (f NCFlavor) ConnectUnix(path string) (string, error) {
+	switch f {
+	case NCNcat:
+		return fmt.Sprintf("nc -U -- %v", ShellQuote(path)), nil
+	case NCOpenBSD:
+		return fmt.Sprintf("nc -N -U -- %v", ShellQuote(path)), nil
+	}
+	return "", fmt.Errorf("%v nc cannot connect unix socket", f)
+}
+
+// Listen accepts one connection on port, with stdin and stdout.
+func (f NCFlavor) Listen(port string) (string, error) {
+	switch f {
+	case NCNcat, NCOpenBSD:
+		return fmt.Sprintf("nc %v-l %v", NCFamily(), ShellQuote(port)), nil
+	case NCTraditional, NCBusybox:
+		return fmt.Sprintf("nc -l -p %v", ShellQuote(port)), nil
+	}
+	return "", fmt.Errorf("%v nc cannot listen", f)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// SessionPool keeps warm sessions of one remote host, which are logged in
+// and waiting at the shell prompt, so that a new forwarded connection
+// needs not wait for the jumper menu, the login and `stty -echo`.
+// Sessions are handed out once and refilled in the background.
+type SessionPool struct {
+	client *SSHClient
+	host   string
+	idle   chan *SSHSession
+	refill chan struct{}
+	quit   chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newSessionPool(client *SSHClient, host string, size int) *SessionPool {
+	p := &SessionPool{
+		client: client,
+		host:   host,
+		idle:   make(chan *SSHSession, size),
+		refill: make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+	}
+	go p.fill()
+	p.kick()
+	return p
+}
+
+// Pool returns the session pool of host, nil if pool is disabled or direct.
+func (client *SSHClient) Pool(host string) *SessionPool {
+	if Options.Pool <= 0 {
+		return nil
+	}
+	if _, ok := client.bastion.(*Direct); ok {
+		return nil // sessions share one ssh connection
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.pools == nil {
+		client.pools = make(map[string]*SessionPool)
+	}
+	p := client.pools[host]
+	if p == nil {
+		p = newSessionPool(client, host, Options.Pool)
+		client.pools[host] = p
+	}
+	return p
+}
+
+// Session returns a warm session of host from pool,
+// or a new one if pool is disabled or empty.
+func (client *SSHClient) Session(host string) (*SSHSession, error) {
+	p := client.Pool(host)
+	if p == nil {
+		return client.NewSession(host)
+	}
+	return p.Get()
+}
+
+func (p *SessionPool) kick() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+func (p *SessionPool) Get() (*SSHSession, error) {
+	defer p.kick()
+	select {
+	case ss := <-p.idle:
+		return ss, nil
+	default:
+		return p.client.NewSession(p.host)
+	}
+}
+
+// fill keeps the pool full, and checks idle sessions periodically,
+// which also keeps them from being kicked out by the idle timeout of jumper.
+func (p *SessionPool) fill() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.refill:
+			p.fillUp()
+		case <-ticker.C:
+			p.check()
+			p.fillUp()
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+func (p *SessionPool) fillUp() {
+	for len(p.idle) < cap(p.idle) {
+		ss, err := p.client.NewSession(p.host)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "session pool of %q: %v\n", p.host, err)
+			return // retry on next kick or tick
+		}
+		// the pool may be closed while logging in
+		if !p.put(ss) {
+			closeSession(ss)
+			return
+		}
+	}
+}
+
+// put adds ss to idle sessions, false if the pool is closed or full.
+func (p *SessionPool) put(ss *SSHSession) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	select {
+	case p.idle <- ss:
+		return true
+	default: // filled by check meanwhile
+		return false
+	}
+}
+
+// check runs `true` in every idle session, and drops broken ones.
+func (p *SessionPool) check() {
+	for n := len(p.idle); n > 0; n-- {
+		var ss *SSHSession
+		select {
+		case ss = <-p.idle:
+		default:
+			return
+		}
+		if !healthy(ss) {
+			if Options.Debug {
+				fmt.Printf("session pool of %q: drop broken session\n", p.host)
+			}
+			closeSession(ss)
+			continue
+		}
+		if !p.put(ss) {
+			closeSession(ss)
+		}
+	}
+}
+
+func healthy(ss *SSHSession) bool {
+	if ss.Start("true", false) != nil {
+		return false
+	}
+	_, code, err := ss.waitFor(time.Duration(Options.Wait) * time.Second)
+	return err == nil && code == 0
+}
+
+func closeSession(ss *SSHSession) {
+	ss.Stdin.Close()
+	ss.Close()
+}
+
+func (p *SessionPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.quit)
+	for {
+		select {
+		case ss := <-p.idle:
+			closeSession(ss)
+		default:
+			return
+		}
+	}
+}
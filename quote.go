@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Everything typed into the remote shell must be quoted by these,
+// except the commands built from them, since the remote shell expands
+// '$', '`', '!', '*', ';' and so on in unquoted or double quoted words.
+
+// shellSafe are the words that need no quoting.
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_./+:@%,-]+$`)
+
+// ShellQuote quotes s as one word for the remote POSIX shell:
+// single quoted, in which nothing expands, and each single quote inside
+// is closed, escaped by backslash, and reopened.
+//
+// Control bytes are acted on by the remote terminal before the shell sees
+// any quotes, e.g. ^C interrupts and '\r' submits a partial line, so they
+// are typed as printf octal escapes instead. Except '\n', which command
+// substitution would strip, and commands with it are refused by typedSafe.
+func ShellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	var b strings.Builder
+	b.WriteByte('\'')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\'':
+			b.WriteString(`'\''`)
+		case c != '\n' && isControl(c):
+			fmt.Fprintf(&b, `'"$(printf '\%03o')"'`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
+
+func isControl(c byte) bool {
+	return c < 0x20 || c == 0x7F
+}
+
+// typedSafe checks a command line to type into the remote terminal.
+func typedSafe(line string) error {
+	for i := 0; i < len(line); i++ {
+		if isControl(line[i]) {
+			return fmt.Errorf("control character %q cannot be typed into the remote shell", line[i])
+		}
+	}
+	return nil
+}
+
+// RemotePath quotes a remote file path, but keeps "~/" expanded by shell.
+func RemotePath(path string) string {
+	if path == "~" {
+		return path
+	}
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		return "~/" + ShellQuote(rest)
+	}
+	return ShellQuote(path)
+}
+
+// validEnvName is the shell variable name, which cannot be quoted.
+var validEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os/exec"
+	"testing"
+)
+
+var quoteTests = []struct {
+	in, out string
+}{
+	{"", "''"},
+	{"abc", "abc"},
+	{"a/b.c:1@x,y-z%", "a/b.c:1@x,y-z%"},
+	{"a b", "'a b'"},
+	{"it's", `'it'\''s'`},
+	{"$HOME", "'$HOME'"},
+	{"`id`", "'`id`'"},
+	{"!!", "'!!'"},
+	{"a;b", "'a;b'"},
+	{"~/x", "'~/x'"},
+	{"a\nb", "'a\nb'"},
+	{"a\rb", `'a'"$(printf '\015')"'b'`},
+	{"\x03\x04\x15\x17\x16\x7f", `''"$(printf '\003')"''"$(printf '\004')"''"$(printf '\025')"''"$(printf '\027')"''"$(printf '\026')"''"$(printf '\177')"''`},
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, tt := range quoteTests {
+		if out := ShellQuote(tt.in); out != tt.out {
+			t.Errorf("ShellQuote(%q) = %q, want %q", tt.in, out, tt.out)
+		}
+	}
+}
+
+// TestShellQuoteShell checks the shell reads the quoted words back as is.
+func TestShellQuoteShell(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh")
+	}
+	for _, tt := range quoteTests {
+		out, err := exec.Command(sh, "-c", "printf %s "+ShellQuote(tt.in)).Output()
+		if err != nil {
+			t.Errorf("sh printf %q: %v", tt.in, err)
+			continue
+		}
+		if string(out) != tt.in {
+			t.Errorf("sh printf %q = %q", tt.in, out)
+		}
+	}
+}
+
+func TestTypedSafe(t *testing.T) {
+	tests := []struct {
+		in string
+		ok bool
+	}{
+		{"ls -l " + ShellQuote("a b"), true},
+		{"cat " + ShellQuote("a\rb\x03"), true},
+		{"cat " + ShellQuote("a\nb"), false},
+		{"a\rb", false},
+		{"a\tb", false},
+		{"a\x7fb", false},
+	}
+	for _, tt := range tests {
+		if err := typedSafe(tt.in); (err == nil) != tt.ok {
+			t.Errorf("typedSafe(%q) = %v, want ok %v", tt.in, err, tt.ok)
+		}
+	}
+}
+
+func TestRemotePath(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"~", "~"},
+		{"~/", "~/''"},
+		{"~/a b", "~/'a b'"},
+		{"~/a/b", "~/a/b"},
+		{"~user/a", "'~user/a'"},
+		{"/tmp/$x", "'/tmp/$x'"},
+		{"it's", `'it'\''s'`},
+		{"", "''"},
+	}
+	for _, tt := range tests {
+		if out := RemotePath(tt.in); out != tt.out {
+			t.Errorf("RemotePath(%q) = %q, want %q", tt.in, out, tt.out)
+		}
+	}
+}
+
+func TestExportCmd(t *testing.T) {
+	tests := []struct {
+		name, value, out string
+	}{
+		{"LANG", "C.UTF-8", "export LANG=C.UTF-8"},
+		{"_X1", "", "export _X1=''"},
+		{"A", "$(id); `id`", "export A='$(id); `id`'"},
+		{"A", "it's", `export A='it'\''s'`},
+		{"1A", "x", ""},
+		{"A-B", "x", ""},
+		{"A;id", "x", ""},
+		{"A B", "x", ""},
+		{"", "x", ""},
+	}
+	for _, tt := range tests {
+		out, err := exportCmd(tt.name, tt.value)
+		if tt.out == "" {
+			if err == nil {
+				t.Errorf("exportCmd(%q) = %q, want error", tt.name, out)
+			}
+			continue
+		}
+		if err != nil || out != tt.out {
+			t.Errorf("exportCmd(%q, %q) = %q, %v, want %q", tt.name, tt.value, out, err, tt.out)
+		}
+	}
+}
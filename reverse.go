@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+type ReverseOptions struct {
+	Remote string `required:"true" desc:"the remote host name or ip to listen on"`
+	Port   string `required:"true" desc:"the port listened on remote host"`
+	Local  string `required:"true" desc:"the local address forward to, format: '[host:]port'"`
+}
+
+// ReverseForward exposes a local service to the remote host:
+// `sncagent listen PORT` runs on remote if available, which opens a mux
+// stream for each connection, or else `nc -l PORT`, bridged through the
+// proxy data channels.
+//
+// Since nc tells nothing when a connection comes in, the local address is
+// dialed when the first bytes arrive, so the remote peer must speak first,
+// which is true for http, most rpc and debug receivers.
+// Connections are served one by one, nc listens again after each one.
+func ReverseForward(ctx context.Context, opts *ReverseOptions) {
+	if opts.Remote == "" {
+		fmt.Fprintln(os.Stderr, "remote host is empty")
+		return
+	}
+	if port, err := strconv.ParseUint(opts.Port, 10, 16); err != nil || port == 0 {
+		fmt.Fprintf(os.Stderr, "remote port %q invalid\n", opts.Port)
+		return
+	}
+	opts.Local = ListenAddr(opts.Local)
+
+	client, err := NewSSHClient()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	fmt.Printf("%v:%v -> %v\n", opts.Remote, opts.Port, opts.Local)
+	if d, ok := client.bastion.(*Direct); ok {
+		reverseDirect(ctx, d, opts)
+		return
+	}
+	if client.Agent(opts.Remote) {
+		for ctx.Err() == nil {
+			if err = reverseAgent(ctx, client, opts); err != nil {
+				time.Sleep(time.Duration(Options.Wait) * time.Second)
+			}
+		}
+		return
+	}
+	fmt.Fprintln(os.Stderr, "warning: by nc, connections are served one at a time, "+
+		"and the remote peer must speak first, so smtp, mysql or ssh hang; use sncagent to lift these")
+	for ctx.Err() == nil {
+		err = reverse(client, opts)
+		if err != nil {
+			// avoid busy loop when remote or proxy is broken
+			time.Sleep(time.Duration(Options.Wait) * time.Second)
+		}
+	}
+}
+
+func reverse(client *SSHClient, opts *ReverseOptions) error {
+	cmd, err := client.ListenCmd(opts.Remote, opts.Port)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", opts.Remote, err)
+		return err
+	}
+	rc, err := client.PipeRemote(opts.Remote, cmd)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// wait for a remote connection
+	buf := make([]byte, 32*1024)
+	n, err := rc.Read(buf)
+	if n == 0 {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "remote listen %v:%v: %v\n", opts.Remote, opts.Port, err)
+		}
+		return err
+	}
+
+	conn, err := net.DialTimeout(Network("tcp"), opts.Local, time.Duration(Options.Wait)*time.Second)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "local dial %q: %v\n", opts.Local, err)
+		return nil // drop this connection only
+	}
+	defer conn.Close()
+	if Options.Debug {
+		fmt.Printf("reverse %v:%v -> %v\n", opts.Remote, opts.Port, opts.Local)
+	}
+
+	_, err = conn.Write(buf[:n])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ssh -> local: %v\n", err)
+		return nil
+	}
+	Pipe(conn, rc)
+	return nil
+}
+
+// reverseAgent serves the connections accepted by `sncagent listen`
+// concurrently, until the session breaks.
+func reverseAgent(ctx context.Context, client *SSHClient, opts *ReverseOptions) error {
+	rc, err := client.AgentRemote(opts.Remote, "listen", ShellQuote(opts.Port))
+	if err != nil {
+		return err
+	}
+	sess := NewMuxSession(rc, rc, rc, false)
+	defer sess.Close()
+	stop := context.AfterFunc(ctx, func() { sess.Close() })
+	defer stop()
+
+	for {
+		st, err := sess.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Fprintf(os.Stderr, "remote listen %v:%v: %v\n", opts.Remote, opts.Port, err)
+			}
+			return err
+		}
+		go func() {
+			defer st.Close()
+			conn, err := net.DialTimeout(Network("tcp"), opts.Local, time.Duration(Options.Wait)*time.Second)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "local dial %q: %v\n", opts.Local, err)
+				st.Reset(err.Error())
+				return
+			}
+			defer conn.Close()
+			if err = st.Accept(); err != nil {
+				return
+			}
+			if Options.Debug {
+				fmt.Printf("reverse %v:%v -> %v, from %v\n", opts.Remote, opts.Port, opts.Local, st.Target())
+			}
+			Pipe(conn, st)
+		}()
+	}
+}
+
+// reverseDirect listens on remote by ssh remote forwarding, as `ssh -R`,
+// so connections are served concurrently and need not speak first.
+func reverseDirect(ctx context.Context, d *Direct, opts *ReverseOptions) {
+	c, err := d.Client(opts.Remote)
+	if err != nil {
+		return
+	}
+	ln, err := c.Listen("tcp", net.JoinHostPort("0.0.0.0", opts.Port))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "remote listen %v:%v: %v\n", opts.Remote, opts.Port, err)
+		return
+	}
+	defer ln.Close()
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		rc, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Fprintf(os.Stderr, "remote accept %v:%v: %v\n", opts.Remote, opts.Port, err)
+			}
+			return
+		}
+		go func() {
+			defer rc.Close()
+			conn, err := net.DialTimeout(Network("tcp"), opts.Local, time.Duration(Options.Wait)*time.Second)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "local dial %q: %v\n", opts.Local, err)
+				return
+			}
+			defer conn.Close()
+			if Options.Debug {
+				fmt.Printf("reverse %v:%v -> %v\n", opts.Remote, opts.Port, opts.Local)
+			}
+			Pipe(conn, rc.(Stream))
+		}()
+	}
+}
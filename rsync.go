@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -63,7 +67,12 @@ func Rsync(ctx context.Context, opts *RsyncOptions) {
 	}
 	defer client.Close()
 
-	listener, err := net.Listen("tcp4", "127.0.0.1:"+opts.Listen)
+	if remote, _ := SplitRemote(opts.Remote); client.Agent(remote) && !client.hasRsync(remote) {
+		agentCopy(client, opts)
+		return
+	}
+
+	listener, err := net.Listen(Network("tcp"), net.JoinHostPort(Loopback(), opts.Listen))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "local ssh server listen on port %q: %v\n", opts.Listen, err)
 		return
@@ -107,8 +116,9 @@ func handleChannel(newChannel ssh.NewChannel, client *SSHClient, remote string)
 		return false
 	}
 
-	if idx := strings.IndexByte(remote, ':'); idx >= 0 {
-		remote = remote[:idx]
+	remote, _ = SplitRemote(remote)
+	if d, ok := client.bastion.(*Direct); ok {
+		return handleDirectChannel(newChannel, client, d, remote)
 	}
 
 	ss, err := client.NewSession(remote)
@@ -131,7 +141,7 @@ func handleChannel(newChannel ssh.NewChannel, client *SSHClient, remote string)
 		if req.Type == "env" {
 			err = setEnv(ss, req)
 		} else if req.Type == "exec" {
-			err = execCmd(ss, req, channel)
+			err = execCmd(ss, req, channel, client, remote)
 		} else {
 			if req.WantReply {
 				err = req.Reply(false, nil)
@@ -144,6 +154,117 @@ func handleChannel(newChannel ssh.NewChannel, client *SSHClient, remote string)
 	return true
 }
 
+// handleDirectChannel relays the channel to an exec channel of remote.
+func handleDirectChannel(newChannel ssh.NewChannel, client *SSHClient, d *Direct, remote string) bool {
+	c, err := d.Client(remote)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return false
+	}
+	session, err := c.NewSession()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ssh open new session: %v\n", err)
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return false
+	}
+	defer session.Close()
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "accept channel: %v\n", err)
+		return false
+	}
+	defer channel.Close()
+
+	for req := range requests {
+		switch req.Type {
+		case "env":
+			var env struct {
+				Name  string
+				Value string
+			}
+			if ssh.Unmarshal(req.Payload, &env) == nil {
+				err = session.Setenv(env.Name, env.Value)
+			}
+			if req.WantReply {
+				req.Reply(err == nil, nil) // sshd may refuse it by AcceptEnv
+			}
+		case "exec":
+			if !execDirect(session, req, channel, client, remote) {
+				return false
+			}
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+	return true
+}
+
+func execDirect(session *ssh.Session, req *ssh.Request, channel ssh.Channel, client *SSHClient, remote string) bool {
+	reply := func(ok bool) {
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+
+	var execMsg struct {
+		Command string
+	}
+	err := ssh.Unmarshal(req.Payload, &execMsg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unmarshal exec cmd: %v\n", err)
+		reply(false)
+		return false
+	}
+	cmd, err := client.ExecCmd(remote, execMsg.Command)
+	if err != nil {
+		reply(false)
+		return false
+	}
+
+	// not session.Stdin, whose copy Wait waits for
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ssh get stdin: %v\n", err)
+		reply(false)
+		return false
+	}
+	session.Stdout = channel
+	session.Stderr = channel.Stderr()
+	if Options.Debug {
+		fmt.Println(cmd)
+	}
+	if err = session.Start(cmd); err != nil {
+		fmt.Fprintf(os.Stderr, "ssh run `%v`: %v\n", cmd, err)
+		reply(false)
+		return false
+	}
+	reply(true)
+
+	go func() {
+		io.Copy(stdin, channel)
+		stdin.Close()
+	}()
+
+	var status struct {
+		Status uint32
+	}
+	if err = session.Wait(); err != nil {
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) {
+			status.Status = uint32(exitErr.ExitStatus())
+		} else {
+			fmt.Fprintf(os.Stderr, "ssh run `%v`: %v\n", cmd, err)
+			status.Status = 255
+		}
+	}
+	channel.SendRequest("exit-status", false, ssh.Marshal(&status))
+	channel.Close()
+	return true
+}
+
 func setEnv(ss *SSHSession, req *ssh.Request) error {
 	var setenvRequest struct {
 		Name  string
@@ -154,7 +275,12 @@ func setEnv(ss *SSHSession, req *ssh.Request) error {
 		fmt.Fprintf(os.Stderr, "unmarshal setenv: %v\n", err)
 		return err
 	}
-	err = ss.Run(fmt.Sprintf("export %v=%q\r", setenvRequest.Name, setenvRequest.Value))
+	cmd, err := exportCmd(setenvRequest.Name, setenvRequest.Value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "setenv: %v\n", err)
+		return err
+	}
+	err = ss.Run(cmd)
 	if err != nil {
 		return err
 	}
@@ -164,7 +290,15 @@ func setEnv(ss *SSHSession, req *ssh.Request) error {
 	return nil
 }
 
-func execCmd(ss *SSHSession, req *ssh.Request, channel ssh.Channel) error {
+// exportCmd returns the command to set env name to value in remote shell.
+func exportCmd(name, value string) (string, error) {
+	if !validEnvName.MatchString(name) {
+		return "", fmt.Errorf("invalid env name %q", name)
+	}
+	return fmt.Sprintf("export %v=%v", name, ShellQuote(value)), nil
+}
+
+func execCmd(ss *SSHSession, req *ssh.Request, channel ssh.Channel, client *SSHClient, remote string) error {
 	reply := func(ok bool) {
 		if req.WantReply {
 			req.Reply(ok, nil)
@@ -194,14 +328,21 @@ func execCmd(ss *SSHSession, req *ssh.Request, channel ssh.Channel) error {
 	}
 	defer c2.Close()
 
-	cmd := fmt.Sprintf("nc -4 -w %v --recv-only %v %v | %v | nc -4 -w %v --send-only %v %v\r",
-		Options.Wait, h1, p1, execMsg.Command, Options.Wait, h2, p2)
-	if Options.Debug {
-		fmt.Println(cmd)
+	cmd, err := client.ExecCmd(remote, execMsg.Command)
+	if err != nil {
+		reply(false)
+		return err
+	}
+	// run by sh -c as sshd does, so that the command cannot break the pipeline
+	cmd = "sh -c " + ShellQuote(cmd)
+	if client.Agent(remote) {
+		cmd = agentLine("exec", h1, p1, h2, p2, "--", cmd)
+	} else if cmd, err = client.RelayCmd(remote, h1, p1, cmd, h2, p2); err != nil {
+		reply(false)
+		return err
 	}
-	_, err = ss.Stdin.Write([]byte(cmd))
+	err = ss.Start(cmd)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "write cmd: %v\n", err)
 		reply(false)
 		return err
 	}
@@ -223,34 +364,48 @@ func execCmd(ss *SSHSession, req *ssh.Request, channel ssh.Channel) error {
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "ssh -> local: %v\n", err)
 	}
+	c1.Close() // remote output is done, so is the command
 	var status struct {
 		Status uint32
 	}
-	status.Status = 0
+	status.Status = exitStatus(ss)
 	channel.SendRequest("exit-status", false, ssh.Marshal(&status))
 	channel.Close()
 	<-wait
 	return nil
 }
 
+// exitStatus returns the exit code of the command started in ss,
+// or 255 as ssh does if unknown in time.
+func exitStatus(ss *SSHSession) uint32 {
+	_, code, err := ss.waitFor(time.Duration(Options.Wait) * time.Second)
+	if err != nil {
+		return 255
+	}
+	return uint32(code)
+}
+
 func StartRsync(ctx context.Context, address string, opts *RsyncOptions) (func() error, func() error, error) {
-	_, port, err := net.SplitHostPort(address)
+	host, port, err := net.SplitHostPort(address)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "split local listen address %q: %v\n", address, err)
 		return nil, nil, err
 	}
 	args := []string{
 		"-avzhP",
+		"-s", // file names are sent by rsync protocol, not by the remote shell
 		"-e", fmt.Sprintf("ssh -p %v", port),
 	}
-	file := ""
-	if idx := strings.IndexByte(opts.Remote, ':'); idx >= 0 {
-		file = opts.Remote[idx+1:]
+	_, file := SplitRemote(opts.Remote)
+	// with -s the remote shell expands nothing, and rsync starts in home
+	file = strings.TrimPrefix(file, "~/")
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
 	}
 	if opts.upload {
-		args = append(args, opts.Target, "127.0.0.1:"+file)
+		args = append(args, opts.Target, host+":"+file)
 	} else {
-		args = append(args, "127.0.0.1:"+file)
+		args = append(args, host+":"+file)
 		if opts.Target == "" {
 			args = append(args, ".")
 		} else {
@@ -271,3 +426,39 @@ func StartRsync(ctx context.Context, address string, opts *RsyncOptions) (func()
 	}
 	return cmd.Wait, cmd.Cancel, nil
 }
+
+func (client *SSHClient) hasRsync(remote string) bool {
+	ss, err := client.Session(remote)
+	if err != nil {
+		return true // let rsync report the error
+	}
+	defer closeSession(ss)
+	_, code, err := ss.Output("command -v rsync")
+	return err != nil || code == 0
+}
+
+// agentCopy copies a single file by sncagent, if no rsync on remote.
+func agentCopy(client *SSHClient, opts *RsyncOptions) {
+	remote, file := SplitRemote(opts.Remote)
+	if Options.Debug {
+		fmt.Printf("no rsync on %q, copy by sncagent\n", remote)
+	}
+	local := opts.Target
+	if opts.upload {
+		if fi, err := os.Stat(local); err != nil || fi.IsDir() {
+			fmt.Fprintf(os.Stderr, "%v: only a single file can be uploaded without rsync on remote\n", local)
+			return
+		}
+		if file == "" || strings.HasSuffix(file, "/") {
+			file += filepath.Base(local)
+		}
+	} else {
+		if local == "" {
+			local = "."
+		}
+		if fi, err := os.Stat(local); err == nil && fi.IsDir() {
+			local = filepath.Join(local, path.Base(file))
+		}
+	}
+	client.AgentCopy(remote, file, local, opts.upload)
+}
@@ -0,0 +1,316 @@
+//go:build ignore
+
+// CGO_ENABLED=0 GOOS=linux go build -ldflags='-w -s' sncagent.go mux.go
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// sncagent is the snc helper on remote hosts, uploaded by snc if missing.
+// It needs neither ncat nor rsync: it connects the proxy data channels
+// itself with -i (the one to read) and -o (the one to write),
+// or uses stdin and stdout if not given.
+
+const usageText = `usage: %v MODE [-w seconds] [-i host:port] [-o host:port] ARGS
+modes:
+  mux                 relay streams multiplexed by snc --tunnel
+  dial host:port      connect host:port, or unix:/path, like nc
+  udp host:port       relay datagrams framed by 2 bytes length to udp host:port
+  listen port         accept tcp connections on port, and open a mux stream for each
+  exec -- cmd args    run cmd with stdin and stdout on data channels
+  get path            send file
+  put path            receive file
+`
+
+type agent struct {
+	timeout time.Duration
+	in      io.Reader
+	out     io.Writer
+	closeW  func() // closes out, the peer reads EOF
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, usageText, os.Args[0])
+	os.Exit(2)
+}
+
+func fatal(format string, a ...any) {
+	fmt.Fprintf(os.Stderr, "sncagent: "+format+"\n", a...)
+	os.Exit(1)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	mode := os.Args[1]
+	fs := flag.NewFlagSet(mode, flag.ExitOnError)
+	wait := fs.Int64("w", 3, "connect timeout, unit: second")
+	in := fs.String("i", "", "data channel to read, default is stdin")
+	out := fs.String("o", "", "data channel to write, default is stdout")
+	fs.Usage = usage
+	fs.Parse(os.Args[2:])
+
+	a := &agent{timeout: time.Duration(*wait) * time.Second}
+	a.open(*in, *out)
+
+	switch mode {
+	case "mux":
+		a.mux()
+	case "dial":
+		if fs.NArg() != 1 {
+			usage()
+		}
+		a.dial(fs.Arg(0))
+	case "listen":
+		if fs.NArg() != 1 {
+			usage()
+		}
+		a.listen(fs.Arg(0))
+	case "udp":
+		if fs.NArg() != 1 {
+			usage()
+		}
+		a.udp(fs.Arg(0))
+	case "exec":
+		if fs.NArg() == 0 {
+			usage()
+		}
+		a.exec(fs.Args())
+	case "get":
+		if fs.NArg() != 1 {
+			usage()
+		}
+		a.get(fs.Arg(0))
+	case "put":
+		if fs.NArg() != 1 {
+			usage()
+		}
+		a.put(fs.Arg(0))
+	default:
+		usage()
+	}
+}
+
+func (a *agent) open(in, out string) {
+	a.in = os.Stdin
+	a.out, a.closeW = os.Stdout, func() { os.Stdout.Close() }
+	if in != "" {
+		conn, err := net.DialTimeout("tcp", in, a.timeout)
+		if err != nil {
+			fatal("connect data channel %v: %v", in, err)
+		}
+		conn.(*net.TCPConn).CloseWrite() // like nc --recv-only
+		a.in = conn
+	}
+	if out != "" {
+		conn, err := net.DialTimeout("tcp", out, a.timeout)
+		if err != nil {
+			fatal("connect data channel %v: %v", out, err)
+		}
+		a.out, a.closeW = conn, func() { conn.Close() }
+	}
+}
+
+func (a *agent) connect(target string) (net.Conn, error) {
+	network, addr := "tcp", target
+	if path, ok := strings.CutPrefix(target, "unix:"); ok {
+		network, addr = "unix", path
+	}
+	return net.DialTimeout(network, addr, a.timeout)
+}
+
+// mux accepts streams from snc, and connects each one to its target.
+func (a *agent) mux() {
+	sess := NewMuxSession(a.in, a.out, nil, false)
+	for {
+		st, err := sess.Accept()
+		if err != nil {
+			if err != io.EOF {
+				fatal("%v", err)
+			}
+			return
+		}
+		go a.serve(st)
+	}
+}
+
+// listen serves snc reverse forwards: it opens a stream to snc for each
+// connection accepted, the target is the address of the peer.
+func (a *agent) listen(port string) {
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		fatal("%v", err)
+	}
+	sess := NewMuxSession(a.in, a.out, nil, true)
+	go func() {
+		<-sess.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if sess.IsClosed() {
+				return
+			}
+			fatal("%v", err)
+		}
+		go func() {
+			defer conn.Close()
+			st, err := sess.Open(conn.RemoteAddr().String())
+			if err != nil {
+				return
+			}
+			defer st.Close()
+			pipe(conn, st, st.CloseWrite)
+		}()
+	}
+}
+
+func (a *agent) serve(st *MuxStream) {
+	conn, err := a.connect(st.Target())
+	if err != nil {
+		st.Reset(err.Error())
+		return
+	}
+	defer conn.Close()
+	defer st.Close()
+	if err = st.Accept(); err != nil {
+		return
+	}
+	pipe(conn, st, st.CloseWrite)
+}
+
+// pipe copies between conn and the peer until both directions done.
+func pipe(conn net.Conn, peer io.ReadWriter, closeWrite func() error) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(conn, peer)
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}()
+	io.Copy(peer, conn)
+	closeWrite()
+	<-done
+}
+
+func (a *agent) dial(target string) {
+	conn, err := a.connect(target)
+	if err != nil {
+		fatal("%v", err)
+	}
+	defer conn.Close()
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{a.in, a.out}
+	pipe(conn, rw, func() error { a.closeW(); return nil })
+}
+
+// udp relays datagrams between the data channels, where each one is
+// framed by a 2 bytes big endian length, and udp target.
+func (a *agent) udp(target string) {
+	conn, err := net.DialTimeout("udp", target, a.timeout)
+	if err != nil {
+		fatal("%v", err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 2+65535)
+		for {
+			n, err := conn.Read(buf[2:])
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				continue // e.g. refused by icmp, as perl relay ignores it
+			}
+			binary.BigEndian.PutUint16(buf, uint16(n))
+			if _, err = a.out.Write(buf[:2+n]); err != nil {
+				fatal("%v", err)
+			}
+		}
+	}()
+	var hdr [2]byte
+	data := make([]byte, 65535)
+	for {
+		if _, err := io.ReadFull(a.in, hdr[:]); err != nil {
+			return
+		}
+		n := binary.BigEndian.Uint16(hdr[:])
+		if _, err := io.ReadFull(a.in, data[:n]); err != nil {
+			return
+		}
+		conn.Write(data[:n]) // lost like a congested network does
+	}
+}
+
+func (a *agent) exec(args []string) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = a.in
+	cmd.Stdout = a.out
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	a.closeW()
+	if err != nil {
+		fatal("%v", err)
+	}
+}
+
+// get replies a status line "ok" or the error, then the file content.
+func (a *agent) get(path string) {
+	defer a.closeW()
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(a.out, "%v\n", err)
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(a.out, "ok\n")
+	if _, err = io.Copy(a.out, f); err != nil {
+		fatal("send %v: %v", path, err)
+	}
+}
+
+// put receives file until EOF, and replies a status line "ok" or the error.
+func (a *agent) put(path string) {
+	defer a.closeW()
+	err := receive(path, a.in)
+	if err != nil {
+		fmt.Fprintf(a.out, "%v\n", err)
+		return
+	}
+	fmt.Fprintf(a.out, "ok\n")
+}
+
+func receive(path string, r io.Reader) error {
+	tmp := path + ".snc.tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
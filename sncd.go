@@ -1,17 +1,22 @@
 //go:build ignore
 
-// go build -ldflags='-w -s' sncd.go crypto.go
+// go build -ldflags='-w -s' sncd.go crypto.go websocket.go
 
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,21 +24,74 @@ func NowString() string {
 	return time.Now().Format("2006-01-02 15:04:05.000")
 }
 
-func handle(c1 *net.TCPConn, timeout time.Duration) {
+type pipeOptions struct {
+	network string // tcp, tcp4 or tcp6
+	lc      net.ListenConfig
+	timeout time.Duration // random port listen timeout
+	idle    time.Duration // pipe idle timeout, 0 means never
+}
+
+// pipeConn is the user side conn of a pipe: a raw tcp conn or a websocket.
+type pipeConn interface {
+	net.Conn
+	CloseRead() error
+	CloseWrite() error
+}
+
+// tlsConn is a server side tls conn,
+// whose read side cannot be closed alone.
+type tlsConn struct {
+	*tls.Conn
+}
+
+func (tc *tlsConn) CloseRead() error {
+	return nil
+}
+
+// activeReader records the time of the last successful read,
+// so that the idle reaper knows whether a pipe is still in use.
+type activeReader struct {
+	r    io.Reader
+	last *atomic.Int64
+}
+
+func (ar *activeReader) Read(p []byte) (n int, err error) {
+	n, err = ar.r.Read(p)
+	if n > 0 {
+		ar.last.Store(time.Now().UnixNano())
+	}
+	return
+}
+
+// handleTLS completes the handshake before handle listens a port for it,
+// so that a peer sending nothing holds no port.
+func handleTLS(tc *tls.Conn, opts *pipeOptions) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	err := tc.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v [%v] tls handshake: %v\n", NowString(), tc.RemoteAddr(), err)
+		tc.Close()
+		return
+	}
+	handle(&tlsConn{tc}, opts)
+}
+
+func handle(c1 pipeConn, opts *pipeOptions) {
 	defer c1.Close()
 
-	listener, err := net.Listen("tcp4", ":0")
+	listener, err := opts.lc.Listen(context.Background(), opts.network, ":0")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v [%v] try listen rand tcp4 port: %v\n",
-			NowString(), c1.RemoteAddr(), err)
+		fmt.Fprintf(os.Stderr, "%v [%v] try listen rand %v port: %v\n",
+			NowString(), c1.RemoteAddr(), opts.network, err)
 		return
 	}
 	defer listener.Close()
 
 	_, port, err := net.SplitHostPort(listener.Addr().String())
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v [%v] split rand tcp4 addr %q: %v\n",
-			NowString(), c1.RemoteAddr(), listener.Addr().String(), err)
+		fmt.Fprintf(os.Stderr, "%v [%v] split rand %v addr %q: %v\n",
+			NowString(), c1.RemoteAddr(), opts.network, listener.Addr().String(), err)
 		return
 	}
 	// fmt.Fprintf(os.Stderr, "%v [%v<->%v] start listen port\n",
@@ -47,7 +105,7 @@ func handle(c1 *net.TCPConn, timeout time.Duration) {
 	}
 	_, err = fmt.Fprintln(c1, port)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v [%v<->%v] write tcp4 port: %v\n",
+		fmt.Fprintf(os.Stderr, "%v [%v<->%v] write rand port: %v\n",
 			NowString(), c1.RemoteAddr(), port, err)
 		return
 	}
@@ -63,7 +121,7 @@ func handle(c1 *net.TCPConn, timeout time.Duration) {
 	stop := func() { once.Do(func() { close(quit) }) }
 	defer stop()
 	go func() {
-		timer := time.NewTimer(timeout)
+		timer := time.NewTimer(opts.timeout)
 		defer timer.Stop()
 		select {
 		case <-timer.C:
@@ -87,21 +145,53 @@ func handle(c1 *net.TCPConn, timeout time.Duration) {
 		NowString(), c1.RemoteAddr(), port, c2.RemoteAddr())
 	start := time.Now()
 	var up, down int64
+	var reason atomic.Pointer[string]
+	setReason := func(format string, args ...any) {
+		s := fmt.Sprintf(format, args...)
+		reason.CompareAndSwap(nil, &s)
+	}
 	defer func() {
-		fmt.Fprintf(os.Stderr, "%v [%v<->%v] pipe with [%v]: up %v bytes, down %v bytes, elapsed %v\n",
-			NowString(), c1.RemoteAddr(), port, c2.RemoteAddr(), up, down, time.Since(start))
+		setReason("closed")
+		fmt.Fprintf(os.Stderr, "%v [%v<->%v] pipe with [%v] %v: up %v bytes, down %v bytes, elapsed %v\n",
+			NowString(), c1.RemoteAddr(), port, c2.RemoteAddr(), *reason.Load(), up, down, time.Since(start))
 	}()
 
+	last := new(atomic.Int64)
+	last.Store(start.UnixNano())
+
+	done := make(chan struct{})
+	defer close(done)
+	if opts.idle > 0 {
+		go func() {
+			ticker := time.NewTicker(min(opts.idle, time.Minute))
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if time.Since(time.Unix(0, last.Load())) >= opts.idle {
+						setReason("reaped after idle %v", opts.idle)
+						c1.Close()
+						c2.Close()
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
 	wg := new(sync.WaitGroup)
 	wg.Add(2)
 
 	go func() {
 		defer wg.Done()
 		var err error
-		down, err = io.Copy(NewRC4Writer(c1, port), c2)
+		down, err = io.Copy(NewRC4Writer(c1, port), &activeReader{r: c2, last: last})
 		c2.CloseRead()
 		c1.CloseWrite()
 		if err != nil && !errors.Is(err, net.ErrClosed) {
+			setReason("broken by [%v]: %v", c2.RemoteAddr(), err)
 			fmt.Fprintf(os.Stderr, "%v [%v<->%v] read from [%v]: %v\n",
 				NowString(), c1.RemoteAddr(), port, c2.RemoteAddr(), err)
 		}
@@ -110,10 +200,11 @@ func handle(c1 *net.TCPConn, timeout time.Duration) {
 	go func() {
 		defer wg.Done()
 		var err error
-		up, err = io.Copy(c2, NewRC4Reader(c1, port))
+		up, err = io.Copy(c2, NewRC4Reader(&activeReader{r: c1, last: last}, port))
 		c1.CloseRead()
 		c2.CloseWrite()
 		if err != nil && !errors.Is(err, net.ErrClosed) {
+			setReason("broken by [%v]: %v", c1.RemoteAddr(), err)
 			fmt.Fprintf(os.Stderr, "%v [%v<->%v] write to [%v]: %v\n",
 				NowString(), c1.RemoteAddr(), port, c2.RemoteAddr(), err)
 		}
@@ -122,16 +213,143 @@ func handle(c1 *net.TCPConn, timeout time.Duration) {
 	wg.Wait()
 }
 
+// newListenConfig enables tcp keepalive on all accepted conns,
+// dead peers are detected after about period*4 without any response.
+func newListenConfig(period time.Duration) net.ListenConfig {
+	if period <= 0 {
+		return net.ListenConfig{KeepAlive: -1}
+	}
+	return net.ListenConfig{
+		KeepAliveConfig: net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     period,
+			Interval: period,
+			Count:    3,
+		},
+	}
+}
+
+// serveWebSocket serves allocation and data channels over websocket on addr,
+// for users who can only reach the proxy by http(s).
+func serveWebSocket(addr, path string, tlsConfig *tls.Config, opts *pipeOptions) error {
+	listener, err := opts.lc.Listen(context.Background(), opts.network, addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := AcceptWebSocket(w, r)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v [%v] websocket: %v\n", NowString(), r.RemoteAddr, err)
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		handle(conn, opts)
+	})
+
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig:         tlsConfig,
+	}
+	if tlsConfig != nil {
+		return srv.ServeTLS(listener, "", "")
+	}
+	return srv.Serve(listener)
+}
+
+// newTLSConfig loads the server certificate, and requires client
+// certificates signed by clientCA for mutual tls if clientCA is given.
+func newTLSConfig(cert, key, clientCA string) (*tls.Config, error) {
+	if cert == "" && key == "" {
+		if clientCA != "" {
+			return nil, errors.New("-client-ca requires -cert and -key")
+		}
+		return nil, nil
+	}
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("load tls key pair: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCA != "" {
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			return nil, fmt.Errorf("read client ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in client ca %q", clientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
 func main() {
 	var port string
-	var timeout int64
+	var timeout, idle, keepalive int64
+	var ipv4, ipv6, useTLS bool
+	var wsAddr, wsPath, cert, key, clientCA string
 	flag.StringVar(&port, "p", "65533", "listen port without host and ':'")
 	flag.Int64Var(&timeout, "t", 60, "random port listen timeout, unit: second")
+	flag.Int64Var(&idle, "i", 86400, "pipe idle timeout, 0 means never, unit: second")
+	flag.Int64Var(&keepalive, "k", 30, "tcp keepalive period, 0 means disabled, unit: second")
+	flag.BoolVar(&ipv4, "4", false, "listen on ipv4 only, default is dual-stack")
+	flag.BoolVar(&ipv6, "6", false, "listen on ipv6 only, default is dual-stack")
+	flag.StringVar(&wsAddr, "ws", "", "websocket listen address, e.g. ':443', default is disabled")
+	flag.StringVar(&wsPath, "ws-path", "/snc", "websocket http path")
+	flag.StringVar(&cert, "cert", "", "tls certificate file, serve websocket over tls if set")
+	flag.StringVar(&key, "key", "", "tls private key file")
+	flag.BoolVar(&useTLS, "tls", false, "serve the control port over tls too, requires -cert and -key")
+	flag.StringVar(&clientCA, "client-ca", "", "require client certificates signed by this ca file (mutual tls)")
 	flag.Parse()
 
-	listener, err := net.Listen("tcp4", ":"+port)
+	tlsConfig, err := newTLSConfig(cert, key, clientCA)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "listen tcp4 port %v: %v\n", port, err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if useTLS && tlsConfig == nil {
+		fmt.Fprintln(os.Stderr, "-tls requires -cert and -key")
+		os.Exit(1)
+	}
+
+	network := "tcp"
+	switch {
+	case ipv4 && ipv6:
+		fmt.Fprintln(os.Stderr, "-4 and -6 cannot be used together")
+		os.Exit(1)
+	case ipv4:
+		network = "tcp4"
+	case ipv6:
+		network = "tcp6"
+	}
+
+	opts := &pipeOptions{
+		network: network,
+		lc:      newListenConfig(time.Duration(keepalive) * time.Second),
+		timeout: time.Duration(timeout) * time.Second,
+		idle:    time.Duration(idle) * time.Second,
+	}
+
+	if wsAddr != "" {
+		go func() {
+			err := serveWebSocket(wsAddr, wsPath, tlsConfig, opts)
+			fmt.Fprintf(os.Stderr, "serve websocket on %v: %v\n", wsAddr, err)
+			os.Exit(1)
+		}()
+	}
+
+	listener, err := opts.lc.Listen(context.Background(), network, ":"+port)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "listen %v port %v: %v\n", network, port, err)
 		os.Exit(1)
 	}
 	defer listener.Close()
@@ -139,9 +357,13 @@ func main() {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "%v tcp4 port %v accept: %v\n", NowString(), port, err)
+			fmt.Fprintf(os.Stderr, "%v %v port %v accept: %v\n", NowString(), network, port, err)
 			continue
 		}
-		go handle(conn.(*net.TCPConn), time.Duration(timeout)*time.Second)
+		if useTLS {
+			go handleTLS(tls.Server(conn, tlsConfig), opts)
+		} else {
+			go handle(conn.(*net.TCPConn), opts)
+		}
 	}
 }
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SocksOptions struct {
+	Remote  string   `required:"true" desc:"the remote host name or ip forward via"`
+	Listen  string   `short:"l" long:"listen" dft:"1080" desc:"local socks5 listen address"`
+	Domains []string `short:"d" long:"domain" sep:"," desc:"internal domains routed via socks5 in the pac file, default is all"`
+	PAC     string   `long:"pac" desc:"also write the pac file to this path"`
+}
+
+// SocksForward runs a local socks5 server, every CONNECT request is
+// forwarded by the remote host just like TCPForward, and the domain
+// name is resolved by the remote host.
+//
+// The pac file is also served on the same port: http://listen/proxy.pac.
+func SocksForward(ctx context.Context, opts *SocksOptions) {
+	if opts.Remote == "" {
+		fmt.Fprintln(os.Stderr, "remote host is empty")
+		return
+	}
+	opts.Listen = ListenAddr(opts.Listen)
+
+	client, err := NewSSHClient()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	listener, err := net.Listen(Network("tcp"), opts.Listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "local listen %q: %v\n", opts.Listen, err)
+		return
+	}
+	defer listener.Close()
+
+	// browsers cannot use an unspecified address such as 0.0.0.0
+	addr := listener.Addr().(*net.TCPAddr)
+	proxyAddr := addr.String()
+	if addr.IP.IsUnspecified() {
+		proxyAddr = net.JoinHostPort(Loopback(), strconv.Itoa(addr.Port))
+	}
+	pac := GeneratePAC(proxyAddr, opts.Domains)
+	if opts.PAC != "" {
+		err = os.WriteFile(opts.PAC, []byte(pac), 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "write pac file: %v\n", err)
+			return
+		}
+	}
+	fmt.Printf("socks5 server listen on %v, pac file: http://%v/proxy.pac\n", addr, proxyAddr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "local accept conn: %v\n", err)
+			continue
+		}
+		go serveSocks(client, opts.Remote, pac, conn)
+	}
+}
+
+// GeneratePAC routes the given domains via socks5 listen, others directly.
+func GeneratePAC(listen string, domains []string) string {
+	proxy := fmt.Sprintf("SOCKS5 %v; SOCKS %v", listen, listen)
+	var sb strings.Builder
+	sb.WriteString("function FindProxyForURL(url, host) {\n")
+	if len(domains) == 0 {
+		fmt.Fprintf(&sb, "  return %q;\n}\n", proxy)
+		return sb.String()
+	}
+	for _, domain := range domains {
+		domain = strings.TrimPrefix(strings.TrimSpace(domain), "*")
+		if domain == "" {
+			continue
+		}
+		if strings.HasPrefix(domain, ".") {
+			fmt.Fprintf(&sb, "  if (dnsDomainIs(host, %q) || host == %q) return %q;\n",
+				domain, domain[1:], proxy)
+		} else {
+			fmt.Fprintf(&sb, "  if (dnsDomainIs(host, %q) || host == %q) return %q;\n",
+				"."+domain, domain, proxy)
+		}
+	}
+	sb.WriteString("  return \"DIRECT\";\n}\n")
+	return sb.String()
+}
+
+const (
+	socksSucceeded           = 0x00
+	socksGeneralFailure      = 0x01
+	socksCmdNotSupported     = 0x07
+	socksAddrTypeUnsupported = 0x08
+)
+
+func serveSocks(client *SSHClient, remote, pac string, conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		return
+	}
+	if first[0] != 0x05 { // not socks5, maybe a browser fetching pac
+		servePAC(conn, br, pac)
+		return
+	}
+
+	host, port, err := socksHandshake(conn, br)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "socks5 handshake with %v: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+	if Options.Debug {
+		fmt.Printf("socks5 connect %v\n", net.JoinHostPort(host, port))
+	}
+
+	rc, err := client.DialRemote(remote, host, port)
+	if err != nil {
+		socksReply(conn, socksGeneralFailure)
+		return
+	}
+	defer rc.Close()
+	if err = socksReply(conn, socksSucceeded); err != nil {
+		return
+	}
+
+	if br.Buffered() > 0 { // data sent before our reply
+		data, _ := br.Peek(br.Buffered())
+		if _, err = rc.Write(data); err != nil {
+			return
+		}
+	}
+	Pipe(conn, rc)
+}
+
+// socksHandshake negotiates no authentication, and reads the CONNECT request.
+func socksHandshake(conn net.Conn, br *bufio.Reader) (host, port string, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(br, hdr[:]); err != nil {
+		return
+	}
+	methods := make([]byte, hdr[1])
+	if _, err = io.ReadFull(br, methods); err != nil {
+		return
+	}
+	if !slices.Contains(methods, 0x00) {
+		conn.Write([]byte{0x05, 0xFF})
+		err = errors.New("client does not support no authentication")
+		return
+	}
+	if _, err = conn.Write([]byte{0x05, 0x00}); err != nil {
+		return
+	}
+
+	var req [4]byte
+	if _, err = io.ReadFull(br, req[:]); err != nil {
+		return
+	}
+	if req[1] != 0x01 {
+		socksReply(conn, socksCmdNotSupported)
+		err = fmt.Errorf("command %v not supported", req[1])
+		return
+	}
+	switch req[3] {
+	case 0x01:
+		ip := make(net.IP, net.IPv4len)
+		if _, err = io.ReadFull(br, ip); err != nil {
+			return
+		}
+		host = ip.String()
+	case 0x04:
+		ip := make(net.IP, net.IPv6len)
+		if _, err = io.ReadFull(br, ip); err != nil {
+			return
+		}
+		host = ip.String()
+	case 0x03:
+		var l [1]byte
+		if _, err = io.ReadFull(br, l[:]); err != nil {
+			return
+		}
+		name := make([]byte, l[0])
+		if _, err = io.ReadFull(br, name); err != nil {
+			return
+		}
+		host = string(name)
+		if err = CheckDialHost(host); err != nil {
+			socksReply(conn, socksGeneralFailure)
+			return
+		}
+	default:
+		socksReply(conn, socksAddrTypeUnsupported)
+		err = fmt.Errorf("address type %v not supported", req[3])
+		return
+	}
+	var p [2]byte
+	if _, err = io.ReadFull(br, p[:]); err != nil {
+		return
+	}
+	port = strconv.Itoa(int(binary.BigEndian.Uint16(p[:])))
+	return
+}
+
+// socksReply replies with bind address 0.0.0.0:0,
+// since the real one is on the remote host and unknown.
+func socksReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{0x05, code, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func servePAC(conn net.Conn, br *bufio.Reader, pac string) {
+	line, err := br.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "GET ") {
+		return
+	}
+	fmt.Fprintf(conn, "HTTP/1.0 200 OK\r\n"+
+		"Content-Type: application/x-ns-proxy-autoconfig\r\n"+
+		"Content-Length: %v\r\n"+
+		"Connection: close\r\n"+
+		"\r\n%v", len(pac), pac)
+}
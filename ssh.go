@@ -1,46 +1,72 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
 type SSHClient struct {
-	sc *ssh.Client
+	bastion Bastion
+
+	mu    sync.Mutex
+	pools map[string]*SessionPool
+
+	tmu     sync.Mutex
+	tunnels map[string]*MuxSession
+	topens  map[string]*tunnelOpen // remote -> tunnel setup in progress
+
+	agents agentCache
+	ncs    ncCache
 }
 
 func NewSSHClient() (*SSHClient, error) {
-	jumper, port, _ := net.SplitHostPort(Options.Jumper)
-	if jumper == "" {
-		jumper = Options.Jumper
-	}
-	if port == "" {
-		port = "22"
-	}
-	if Options.Debug {
-		fmt.Printf("%v ssh -p %v %v@%v\n", Dollar, port, Options.User, jumper)
-	}
-	client, err := newSSHClient()
+	bastion, err := NewBastion()
 	if err != nil {
 		return nil, err
 	}
-	return &SSHClient{sc: client}, nil
+	return &SSHClient{bastion: bastion}, nil
 }
 
 func (client *SSHClient) Close() error {
-	return client.sc.Close()
+	client.mu.Lock()
+	for _, p := range client.pools {
+		p.Close()
+	}
+	client.pools = nil
+	client.mu.Unlock()
+
+	client.tmu.Lock()
+	for _, t := range client.tunnels {
+		t.Close()
+	}
+	client.tunnels = nil
+	client.tmu.Unlock()
+	return client.bastion.Close()
 }
 
+// NewSession logs in host through the bastion, and sets up the shell.
+// Host "hostA/hostB" logs in hostA, then ssh on to hostB in the same pty,
+// except that the direct bastion logs in all hops by ssh channels.
 func (client *SSHClient) NewSession(host string) (*SSHSession, error) {
-	ssh, err := newSession(client.sc)
+	first, rest := host, ""
+	if _, ok := client.bastion.(*Direct); !ok {
+		first, rest, _ = strings.Cut(host, "/")
+	}
+	ssh, err := client.bastion.Login(first)
 	if err != nil {
 		return nil, err
 	}
@@ -51,42 +77,43 @@ func (client *SSHClient) NewSession(host string) (*SSHSession, error) {
 		}
 	}()
 
-	// wait input hostname
-	_, err = DiscardUntil(ssh.Stdout, '>')
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "discard until '>': %v\n", err)
-		return nil, err
-	}
-	_, err = DiscardMany(ssh.Stdout)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "discard space before type host: %v\n", err)
-		return nil, err
-	}
-
-	// input hostname
-	fmt.Fprintf(ssh.Stdin, "%v\r", host)
-	// whether connect to the host or any error
-	err = ParseConnectHostError(ssh.Stdout)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "ssh connect to %q: %v\n", host, err)
-		return nil, err
-	}
-	_, err = DiscardMany(ssh.Stdout)
+	// disable ssh echo, and clear prompts
+	err = ssh.setupShell()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "discard space after type host: %v\n", err)
 		return nil, err
 	}
-
-	// disable ssh echo
-	err = ssh.Run("stty -echo\r", false)
-	if err != nil {
-		return nil, err
+	for rest != "" {
+		var hop string
+		hop, rest, _ = strings.Cut(rest, "/")
+		if err = ssh.hop(hop); err != nil {
+			return nil, err
+		}
 	}
 
 	ok = true
 	return ssh, nil
 }
 
+// hop logs in host by ssh from the shell. The shell is replaced by ssh,
+// so that a failed login ends the session, instead of going on with
+// the previous host.
+func (ss *SSHSession) hop(host string) error {
+	name, account := hopAccount(host)
+	cmd := "exec ssh -tt -o BatchMode=yes "
+	if account != "" {
+		cmd += "-l " + ShellQuote(account) + " "
+	}
+	cmd += ShellQuote(name)
+	if Options.Debug {
+		fmt.Println(cmd)
+	}
+	if _, err := ss.Stdin.Write([]byte(cmd + "\r")); err != nil {
+		fmt.Fprintf(os.Stderr, "ssh hop to %q: %v\n", host, err)
+		return err
+	}
+	return ss.setupShell()
+}
+
 func getEnvHome() string {
 	for _, env := range os.Environ() {
 		key, value, ok := strings.Cut(env, "=")
@@ -123,9 +150,22 @@ func loadPrivateKey() (ssh.Signer, error) {
 	return signer, nil
 }
 
-func newSSHClient() (*ssh.Client, error) {
+// newSSHClient logs in addr as user with the private key.
+func newSSHClient(addr, user string) (*ssh.Client, error) {
+	conn, err := Dial(addr)
+	if err != nil {
+		err = fmt.Errorf("dial %q: %w", addr, err)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+	return sshHandshake(conn, addr, user)
+}
+
+// sshHandshake logs in addr over conn, which is closed if failed.
+func sshHandshake(conn net.Conn, addr, user string) (*ssh.Client, error) {
 	signer, err := loadPrivateKey()
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
@@ -136,7 +176,7 @@ func newSSHClient() (*ssh.Client, error) {
 			Ciphers:      algorithms.Ciphers,
 			MACs:         algorithms.MACs,
 		},
-		User: Options.User,
+		User: user,
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(signer),
 		},
@@ -145,13 +185,18 @@ func newSSHClient() (*ssh.Client, error) {
 		Timeout:           time.Duration(Options.Wait) * time.Second,
 	}
 
-	client, err := ssh.Dial("tcp", Options.Jumper, config)
+	if config.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(config.Timeout))
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
 	if err != nil {
-		err = fmt.Errorf("dial %q: %w", Options.Jumper, err)
+		conn.Close()
+		err = fmt.Errorf("ssh handshake with %q: %w", addr, err)
 		fmt.Fprintln(os.Stderr, err)
 		return nil, err
 	}
-	return client, nil
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
 }
 
 type SSHSession struct {
@@ -160,6 +205,11 @@ type SSHSession struct {
 	Stdin   io.WriteCloser
 	Stdout  io.Reader
 	Stderr  io.Reader
+
+	exp      *Expect
+	sentinel string  // unique marker of command boundaries
+	done     Pattern // end marker with the exit code
+	cmd      string  // the command started but not waited
 }
 
 func (ss *SSHSession) Close() error {
@@ -173,7 +223,8 @@ func (ss *SSHSession) Close() error {
 	return e1
 }
 
-func newSession(client *ssh.Client) (ss *SSHSession, err error) {
+// newSession opens a pty session running cmd, or the login shell if empty.
+func newSession(client *ssh.Client, cmd string) (ss *SSHSession, err error) {
 	session, err := client.NewSession()
 	if err != nil {
 		err = fmt.Errorf("ssh open new session: %w", err)
@@ -223,7 +274,11 @@ func newSession(client *ssh.Client) (ss *SSHSession, err error) {
 		return nil, err
 	}
 
-	err = session.Shell()
+	if cmd == "" {
+		err = session.Shell()
+	} else {
+		err = session.Start(cmd)
+	}
 	if err != nil {
 		err = fmt.Errorf("ssh start shell: %w", err)
 		fmt.Fprintln(os.Stderr, err)
@@ -236,10 +291,47 @@ func newSession(client *ssh.Client) (ss *SSHSession, err error) {
 		Stdin:   stdin,
 		Stdout:  stdout,
 		Stderr:  stderr,
+		exp:     NewExpect(stdout),
 	}, nil
 }
 
-func (ss *SSHSession) Run(cmd string, echo ...bool) error {
+// Commands are wrapped by begin and end markers with the session sentinel:
+// `printf SENTINEL:B; cmd; printf SENTINEL:E:$?`, so that the output and
+// the exit code of cmd are known exactly, whatever PS1, motd or output is.
+// The printf format splits the marker, so that an echoed command line
+// never looks like the marker.
+
+// stepTimeout is the timeout of each step talking to jumper and remote shell.
+func stepTimeout() time.Duration {
+	return time.Duration(Options.Timeout) * time.Second
+}
+
+// setupShell clears the prompts and disables echo, and waits until done,
+// which also proves that the shell is ready.
+func (ss *SSHSession) setupShell() error {
+	var b [6]byte
+	rand.Read(b[:])
+	ss.sentinel = "snc" + hex.EncodeToString(b[:])
+	ss.done = Regexp(regexp.QuoteMeta(ss.sentinel+":E:") + `(-?[0-9]+)\r?\n`)
+
+	cmd := fmt.Sprintf("stty -echo; unset PROMPT_COMMAND; PS1='' PS2='' PROMPT='' RPROMPT=''; printf '%%s:%%s\\n' %v READY\r", ss.sentinel)
+	if Options.Debug {
+		fmt.Println(cmd)
+	}
+	if _, err := ss.Stdin.Write([]byte(cmd)); err != nil {
+		fmt.Fprintf(os.Stderr, "ssh setup shell: %v\n", err)
+		return err
+	}
+	_, _, err := ss.exp.Expect("shell ready", stepTimeout(), Literal(ss.sentinel+":READY\r\n"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ssh setup shell: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// Start types cmd wrapped by markers, the end marker is read by Wait.
+func (ss *SSHSession) Start(cmd string, echo ...bool) error {
 	ec := true
 	if len(echo) > 0 {
 		ec = echo[0]
@@ -247,28 +339,66 @@ func (ss *SSHSession) Run(cmd string, echo ...bool) error {
 	if Options.Debug && ec {
 		fmt.Println(cmd)
 	}
-	_, err := ss.Stdin.Write([]byte(cmd))
+	if err := typedSafe(cmd); err != nil {
+		fmt.Fprintf(os.Stderr, "ssh run %q: %v\n", cmd, err)
+		return err
+	}
+	line := fmt.Sprintf("printf '%%s:B\\n' %v; %v; printf '%%s:E:%%s\\n' %v \"$?\"\r", ss.sentinel, cmd, ss.sentinel)
+	_, err := ss.Stdin.Write([]byte(line))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "ssh run `%v` write cmd: %v\n", cmd, err)
 		return err
 	}
-	return ss.WaitPS1()
+	ss.cmd = cmd
+	return nil
+}
+
+// Wait waits the command started, and returns its output and exit code.
+func (ss *SSHSession) Wait() (string, int, error) {
+	return ss.waitFor(stepTimeout())
 }
 
-func (ss *SSHSession) WaitPS1() error {
-	_, err := DiscardUntil(ss.Stdout, '$')
+func (ss *SSHSession) waitFor(timeout time.Duration) (string, int, error) {
+	_, out, err := ss.exp.Expect(fmt.Sprintf("end of `%v`", ss.cmd), timeout, ss.done)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "ssh wait PS1: %v\n", err)
-		return err
+		fmt.Fprintf(os.Stderr, "ssh: %v\n", err)
+		return "", 0, err
 	}
-	_, err = DiscardMany(ss.Stdout)
+	ss.cmd = ""
+
+	m := ss.done.re.FindSubmatchIndex(out)
+	code, _ := strconv.Atoi(string(out[m[2]:m[3]]))
+	out = out[:m[0]]
+	// output without a trailing newline ends right before the end marker
+	if i := bytes.Index(out, []byte(ss.sentinel+":B\r\n")); i >= 0 {
+		out = out[i+len(ss.sentinel)+4:]
+	}
+	output := strings.ReplaceAll(string(out), "\r\n", "\n")
+	return strings.TrimSuffix(output, "\n"), code, nil
+}
+
+// Run runs cmd, and returns an error if it exits non-zero.
+func (ss *SSHSession) Run(cmd string, echo ...bool) error {
+	_, code, err := ss.Output(cmd, echo...)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "ssh wait PS1 done: %v\n", err)
+		return err
+	}
+	if code != 0 {
+		err = fmt.Errorf("ssh run `%v`: exit status %v", cmd, code)
+		fmt.Fprintln(os.Stderr, err)
 		return err
 	}
 	return nil
 }
 
+// Output runs cmd, and returns its output and exit code.
+func (ss *SSHSession) Output(cmd string, echo ...bool) (string, int, error) {
+	if err := ss.Start(cmd, echo...); err != nil {
+		return "", 0, err
+	}
+	return ss.Wait()
+}
+
 func (ss *SSHSession) SendEOF() error {
 	if Options.Debug {
 		fmt.Println("^D")
@@ -292,23 +422,19 @@ func (ss *SSHSession) SendTERM() error {
 }
 
 func (ss *SSHSession) Quit() error {
-	err := ss.WaitPS1()
-	if err != nil {
-		return err
+	if ss.cmd != "" {
+		if _, _, err := ss.Wait(); err != nil {
+			return err
+		}
 	}
-	err = ss.SendEOF()
+	err := ss.SendEOF()
 	if err != nil {
 		return err
 	}
 
-	_, err = DiscardUntil(ss.Stdout, '>')
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "ssh wait jumper: %v\n", err)
-		return err
-	}
-	_, err = DiscardMany(ss.Stdout)
+	_, _, err = ss.exp.Expect("jumper menu", stepTimeout(), menuPrompt)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "ssh wait jumper done: %v\n", err)
+		fmt.Fprintf(os.Stderr, "ssh: %v\n", err)
 		return err
 	}
 
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// Remote command templates in config override the generated commands,
+// e.g. for `/usr/local/bin/ncat`, `sudo` or `timeout` wrappers:
+//
+//	recv    read data channel .Host:.Port to stdout
+//	send    write stdin to data channel .Host:.Port
+//	relay   the pipeline of .Recv, .Cmd and .Send
+//	connect connect .TargetHost:.TargetPort with stdin and stdout
+//	unix    connect unix socket .Path with stdin and stdout
+//	listen  accept one connection on .Port with stdin and stdout
+//	exec    wrap .Cmd run by rsync
+//
+// .Wait and .Family (the nc option "-4 ", "-6 " or "") are always set.
+// Hosts, ports and paths are shell quoted already, and .Cmd is a command.
+var templateNames = []string{"recv", "send", "relay", "connect", "unix", "listen", "exec"}
+
+// TemplateData is the variables of remote command templates.
+type TemplateData struct {
+	Host       string // data channel host
+	Port       string // data channel port, or listen port
+	TargetHost string
+	TargetPort string
+	Path       string
+	Cmd        string
+	Recv       string
+	Send       string
+	Wait       int64
+	Family     string
+}
+
+// parseTemplates parses and checks all templates, so that
+// a bad one fails on loading instead of on the first connection.
+func (conf *Config) parseTemplates() error {
+	conf.tmpls = make(map[string]*template.Template)
+	parse := func(host string, tmpls map[string]string) error {
+		for name, text := range tmpls {
+			where := fmt.Sprintf("template %q", name)
+			if host != "" {
+				where = fmt.Sprintf("template %q of host %q", name, host)
+			}
+			if !slices.Contains(templateNames, name) {
+				return fmt.Errorf("%v: unknown, valid names: %v", where, strings.Join(templateNames, ", "))
+			}
+			t, err := template.New(name).Option("missingkey=error").Parse(text)
+			if err != nil {
+				return fmt.Errorf("%v: %w", where, err)
+			}
+			if err = t.Execute(io.Discard, new(TemplateData)); err != nil {
+				return fmt.Errorf("%v: %w", where, err)
+			}
+			conf.tmpls[host+"/"+name] = t
+		}
+		return nil
+	}
+
+	if err := parse("", conf.Templates); err != nil {
+		return err
+	}
+	for host, hc := range conf.Hosts {
+		if hc == nil {
+			continue
+		}
+		if err := parse(host, hc.Templates); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// template returns template name of host, the last hop of remote,
+// or the global one, nil if none.
+func (conf *Config) template(remote, name string) *template.Template {
+	host := remote[strings.LastIndexByte(remote, '/')+1:]
+	host, _, _ = strings.Cut(host, "@")
+	if t := conf.tmpls[host+"/"+name]; t != nil {
+		return t
+	}
+	return conf.tmpls["/"+name]
+}
+
+// render renders template name of remote, or returns dft() if not configured.
+func (client *SSHClient) render(remote, name string, data *TemplateData, dft func() (string, error)) (string, error) {
+	t := Conf.template(remote, name)
+	if t == nil {
+		return dft()
+	}
+	data.Wait = Options.Wait
+	data.Family = NCFamily()
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		fmt.Fprintf(os.Stderr, "render template %q of %q: %v\n", name, remote, err)
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// RecvCmd reads data channel host:port to stdout on remote.
+func (client *SSHClient) RecvCmd(remote, host, port string) (string, error) {
+	return client.render(remote, "recv", &TemplateData{Host: ShellQuote(host), Port: ShellQuote(port)}, func() (string, error) {
+		return client.NC(remote).Recv(host, port), nil
+	})
+}
+
+// SendCmd writes stdin to data channel host:port on remote.
+func (client *SSHClient) SendCmd(remote, host, port string) (string, error) {
+	return client.render(remote, "send", &TemplateData{Host: ShellQuote(host), Port: ShellQuote(port)}, func() (string, error) {
+		return client.NC(remote).Send(host, port), nil
+	})
+}
+
+// RelayCmd runs cmd on remote with stdin from data channel 1,
+// and stdout to data channel 2.
+func (client *SSHClient) RelayCmd(remote, h1, p1, cmd, h2, p2 string) (string, error) {
+	recv, err := client.RecvCmd(remote, h1, p1)
+	if err != nil {
+		return "", err
+	}
+	send, err := client.SendCmd(remote, h2, p2)
+	if err != nil {
+		return "", err
+	}
+	return client.render(remote, "relay", &TemplateData{Recv: recv, Cmd: cmd, Send: send}, func() (string, error) {
+		return fmt.Sprintf("%v | %v | %v", recv, cmd, send), nil
+	})
+}
+
+// ConnectCmd connects host:port on remote.
+func (client *SSHClient) ConnectCmd(remote, host, port string) (string, error) {
+	return client.render(remote, "connect", &TemplateData{TargetHost: ShellQuote(host), TargetPort: ShellQuote(port)}, func() (string, error) {
+		return client.NC(remote).Connect(host, port), nil
+	})
+}
+
+// UnixCmd connects unix socket path on remote.
+func (client *SSHClient) UnixCmd(remote, path string) (string, error) {
+	return client.render(remote, "unix", &TemplateData{Path: ShellQuote(path)}, func() (string, error) {
+		return client.NC(remote).ConnectUnix(path)
+	})
+}
+
+// ListenCmd accepts one connection on port of remote.
+func (client *SSHClient) ListenCmd(remote, port string) (string, error) {
+	return client.render(remote, "listen", &TemplateData{Port: ShellQuote(port)}, func() (string, error) {
+		return client.NC(remote).Listen(port)
+	})
+}
+
+// ExecCmd wraps cmd run by rsync on remote.
+func (client *SSHClient) ExecCmd(remote, cmd string) (string, error) {
+	return client.render(remote, "exec", &TemplateData{Cmd: cmd}, func() (string, error) {
+		return cmd, nil
+	})
+}
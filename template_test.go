@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func loadTestConfig(t *testing.T, data string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadConfig(path)
+}
+
+func TestParseTemplatesInvalid(t *testing.T) {
+	tests := []struct {
+		name, config, err string
+	}{
+		{"unknown name", `{"templates": {"conect": "nc {{.TargetHost}} {{.TargetPort}}"}}`,
+			`template "conect": unknown`},
+		{"unknown name of host", `{"hosts": {"db-01": {"templates": {"lsten": "nc -l {{.Port}}"}}}}`,
+			`template "lsten" of host "db-01": unknown`},
+		{"bad syntax", `{"templates": {"connect": "nc {{.TargetHost} {{.TargetPort}}"}}`,
+			`template "connect": template: connect:1: `},
+		{"unknown field", `{"templates": {"recv": "nc {{.Hostname}} {{.Port}}"}}`,
+			`template "recv": template: recv:1:5: executing "recv" at <.Hostname>: can't evaluate field Hostname`},
+	}
+	for _, tt := range tests {
+		_, err := loadTestConfig(t, tt.config)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v: LoadConfig error %v, want containing %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestRenderTemplates(t *testing.T) {
+	defer func(opts *RunOptions, conf *Config) { Options, Conf = opts, conf }(Options, Conf)
+
+	conf, err := loadTestConfig(t, `{
+		"templates": {"connect": "/usr/local/bin/ncat -w {{.Wait}} {{.TargetHost}} {{.TargetPort}}"},
+		"hosts": {
+			"db-01": {"templates": {"connect": "sudo nc {{.Family}}{{.TargetHost}} {{.TargetPort}}"}},
+			"web-01": {"account": "ops"}
+		}
+	}`)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	Options = &RunOptions{Wait: 3, IPv4: true}
+	Conf = conf
+	client := new(SSHClient)
+	// no nc probe on a fake remote
+	client.ncs.remote = map[string]NCFlavor{"web-01": NCOpenBSD, "app-01": NCOpenBSD}
+
+	tests := []struct {
+		remote, cmd string
+	}{
+		// the host template beats the global one, on the last hop
+		{"db-01", "sudo nc -4 10.0.0.1 3306"},
+		{"db-01@root", "sudo nc -4 10.0.0.1 3306"},
+		{"jump/db-01@root", "sudo nc -4 10.0.0.1 3306"},
+		// hosts without their own use the global one
+		{"web-01", "/usr/local/bin/ncat -w 3 10.0.0.1 3306"},
+		{"db-01/web-01", "/usr/local/bin/ncat -w 3 10.0.0.1 3306"},
+	}
+	for _, tt := range tests {
+		cmd, err := client.ConnectCmd(tt.remote, "10.0.0.1", "3306")
+		if err != nil || cmd != tt.cmd {
+			t.Errorf("ConnectCmd(%q) = %q, %v, want %q", tt.remote, cmd, err, tt.cmd)
+		}
+	}
+
+	// the built-in command if no template at all
+	cmd, err := client.UnixCmd("app-01", "/run/app.sock")
+	if want := "nc -N -U -- /run/app.sock"; err != nil || cmd != want {
+		t.Errorf("UnixCmd without template = %q, %v, want %q", cmd, err, want)
+	}
+	cmd, err = client.ListenCmd("web-01", "9000")
+	if want := "nc -4 -l 9000"; err != nil || cmd != want {
+		t.Errorf("ListenCmd without template = %q, %v, want %q", cmd, err, want)
+	}
+}
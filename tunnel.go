@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Tunnel returns the mux session to sncagent on remote, which is started
+// on first use by `sncagent mux -i CH1 -o CH2`, and restarted if broken.
+// All streams to remote share the one session, so new connections
+// need no jumper session or proxy channels at all.
+func (client *SSHClient) Tunnel(remote string) (*MuxSession, error) {
+	client.tmu.Lock()
+	if t := client.tunnels[remote]; t != nil && !t.IsClosed() {
+		client.tmu.Unlock()
+		return t, nil
+	}
+	if o := client.topens[remote]; o != nil {
+		client.tmu.Unlock()
+		<-o.done
+		return o.t, o.err
+	}
+	o := &tunnelOpen{done: make(chan struct{})}
+	if client.topens == nil {
+		client.topens = make(map[string]*tunnelOpen)
+	}
+	client.topens[remote] = o
+	client.tmu.Unlock()
+
+	o.t, o.err = client.openTunnel(remote)
+
+	client.tmu.Lock()
+	delete(client.topens, remote)
+	if o.err == nil {
+		if client.tunnels == nil {
+			client.tunnels = make(map[string]*MuxSession)
+		}
+		client.tunnels[remote] = o.t
+	}
+	client.tmu.Unlock()
+	close(o.done)
+	return o.t, o.err
+}
+
+// tunnelOpen is a tunnel setup in progress, which the others to the same
+// remote wait for, while tunnels to other remotes are set up in parallel.
+type tunnelOpen struct {
+	done chan struct{}
+	t    *MuxSession
+	err  error
+}
+
+func (client *SSHClient) openTunnel(remote string) (*MuxSession, error) {
+	client.Agent(remote) // upload it if missing
+	rc, err := client.AgentRemote(remote, "mux")
+	if err != nil {
+		return nil, err
+	}
+	t := NewMuxSession(rc, rc, rc, true)
+	if Options.Debug {
+		fmt.Printf("tunnel to %q open\n", remote)
+		go func() {
+			<-t.Done()
+			fmt.Printf("tunnel to %q closed\n", remote)
+		}()
+	}
+	return t, nil
+}
+
+// OpenTunnel opens a stream to target, "host:port" or "unix:/path",
+// via the tunnel of remote.
+func (client *SSHClient) OpenTunnel(remote, target string) (Stream, error) {
+	t, err := client.Tunnel(remote)
+	if err != nil {
+		return nil, err
+	}
+	st, err := t.Open(target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tunnel %q connect %v: %v\n", remote, target, err)
+		return nil, err
+	}
+	return st, nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Datagrams are framed by a 2 bytes big endian length on the data channels,
+// since the proxy leg is a tcp stream.
+//
+// The remote relay is `sncagent udp` if the agent is there, or else a perl
+// one-liner. Not `nc -u`, because nc reads its stdin pipe in arbitrary
+// chunks, and merges datagrams arrived together.
+const udpRelayScript = `use %[1]v; use IO::Select; ` +
+	`binmode STDIN; binmode STDOUT; ` +
+	`my $s = %[1]v->new(PeerAddr => "%[2]v", PeerPort => %[3]v, Proto => "udp") or die "udp: $!\n"; ` +
+	`my $sel = IO::Select->new(\*STDIN, $s); my $in = ""; ` +
+	`while (my @r = $sel->can_read) { for my $h (@r) { ` +
+	`if ($h == $s) { my $d; defined($s->recv($d, 65535)) or next; syswrite(STDOUT, pack("n", length $d) . $d); } ` +
+	`else { sysread(STDIN, my $b, 65536) or exit; $in .= $b; ` +
+	`while (length $in >= 2) { my $l = unpack("n", $in); last if length $in < 2 + $l; ` +
+	`$s->send(substr($in, 2, $l)); substr($in, 0, 2 + $l) = ""; } } } }`
+
+var validUDPHost = regexp.MustCompile(`^[A-Za-z0-9._:-]+$`)
+
+func udpRelayCmd(host, port string) string {
+	module := "IO::Socket::INET"
+	if Options.IPv6 || net.ParseIP(host).To4() == nil && net.ParseIP(host) != nil {
+		module = "IO::Socket::IP" // ipv6 capable, core module since perl 5.20
+	}
+	return "perl -e " + ShellQuote(fmt.Sprintf(udpRelayScript, module, host, port))
+}
+
+// udpRelay is the framing relay of a udp forward on remote.
+type udpRelay struct {
+	agent bool // sncagent, or else perl
+}
+
+// findUDPRelay returns sncagent if available on remote, or perl.
+// It fails if neither is there.
+func findUDPRelay(client *SSHClient, remote string) (*udpRelay, error) {
+	if client.Agent(remote) {
+		return &udpRelay{agent: true}, nil
+	}
+	ok, err := client.hasPerl(remote)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		err = fmt.Errorf("udp forward via %q needs perl or sncagent on it", remote)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+	return &udpRelay{}, nil
+}
+
+func (client *SSHClient) hasPerl(remote string) (bool, error) {
+	ss, err := client.Session(remote)
+	if err != nil {
+		return false, err
+	}
+	defer closeSession(ss)
+	_, code, err := ss.Output("command -v perl >/dev/null")
+	if err != nil {
+		return false, err
+	}
+	return code == 0, nil
+}
+
+// open starts the relay to udp host:port on remote.
+func (r *udpRelay) open(client *SSHClient, remote, host, port string) (Stream, error) {
+	if !r.agent {
+		return client.PipeRemote(remote, udpRelayCmd(host, port))
+	}
+	rc, err := client.AgentRemote(remote, "udp", ShellQuote(net.JoinHostPort(host, port)))
+	if err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+// udpRelayCache keeps the relay found for a udp forward. Failures are not
+// kept, the next client tries again, while the others wait for the one
+// in progress.
+type udpRelayCache struct {
+	mu    sync.Mutex
+	relay *udpRelay
+	find  *udpRelayFind
+}
+
+type udpRelayFind struct {
+	done  chan struct{}
+	relay *udpRelay
+	err   error
+}
+
+func (rc *udpRelayCache) get(client *SSHClient, remote string) (*udpRelay, error) {
+	rc.mu.Lock()
+	if rc.relay != nil {
+		rc.mu.Unlock()
+		return rc.relay, nil
+	}
+	if f := rc.find; f != nil {
+		rc.mu.Unlock()
+		<-f.done
+		return f.relay, f.err
+	}
+	f := &udpRelayFind{done: make(chan struct{})}
+	rc.find = f
+	rc.mu.Unlock()
+
+	f.relay, f.err = findUDPRelay(client, remote)
+
+	rc.mu.Lock()
+	rc.find = nil
+	if f.err == nil {
+		rc.relay = f.relay
+	}
+	rc.mu.Unlock()
+	close(f.done)
+	return f.relay, f.err
+}
+
+type udpSession struct {
+	addr net.Addr
+	ch   chan []byte
+	last atomic.Int64
+}
+
+func (us *udpSession) touch() {
+	us.last.Store(time.Now().UnixNano())
+}
+
+// UDPForward relays datagrams of each client on pc via its own
+// remote relay, which expires after timeout idle.
+func UDPForward(client *SSHClient, spec *ForwardSpec, pc net.PacketConn, timeout time.Duration) {
+	host, port := spec.host, spec.port
+	if !validUDPHost.MatchString(host) {
+		fmt.Fprintf(os.Stderr, "invalid udp server host %q\n", host)
+		return
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid udp server port %q\n", port)
+		return
+	}
+
+	// found on the first datagram, since remote may be down by then
+	relays := new(udpRelayCache)
+	mu := new(sync.Mutex)
+	sessions := make(map[string]*udpSession)
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				fmt.Fprintf(os.Stderr, "local read udp: %v\n", err)
+			}
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		mu.Lock()
+		us := sessions[addr.String()]
+		if us == nil {
+			us = &udpSession{addr: addr, ch: make(chan []byte, 64)}
+			us.touch()
+			sessions[addr.String()] = us
+			go func() {
+				if r, err := relays.get(client, spec.Remote); err == nil {
+					relayUDP(client, spec.Remote, host, port, r, pc, us, timeout)
+				}
+				mu.Lock()
+				delete(sessions, addr.String())
+				mu.Unlock()
+			}()
+		}
+		mu.Unlock()
+
+		select {
+		case us.ch <- data:
+		default: // drop like a congested network does
+		}
+	}
+}
+
+func relayUDP(client *SSHClient, remote, host, port string, relay *udpRelay, pc net.PacketConn, us *udpSession, timeout time.Duration) {
+	rc, err := relay.open(client, remote, host, port)
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+	if Options.Debug {
+		fmt.Printf("udp session %v -> %v open\n", us.addr, net.JoinHostPort(host, port))
+		defer fmt.Printf("udp session %v -> %v closed\n", us.addr, net.JoinHostPort(host, port))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var hdr [2]byte
+		buf := make([]byte, 65535)
+		for {
+			if _, err := io.ReadFull(rc, hdr[:]); err != nil {
+				return
+			}
+			data := buf[:binary.BigEndian.Uint16(hdr[:])]
+			if _, err := io.ReadFull(rc, data); err != nil {
+				return
+			}
+			us.touch()
+			if _, err := pc.WriteTo(data, us.addr); err != nil {
+				fmt.Fprintf(os.Stderr, "local write udp to %v: %v\n", us.addr, err)
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(min(timeout, 10*time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case data := <-us.ch:
+			us.touch()
+			frame := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(data)), uint16(len(data)))
+			if _, err := rc.Write(append(frame, data...)); err != nil {
+				fmt.Fprintf(os.Stderr, "local -> ssh: %v\n", err)
+				return
+			}
+		case <-ticker.C:
+			if time.Since(time.Unix(0, us.last.Load())) >= timeout {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
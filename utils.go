@@ -2,12 +2,21 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net"
+	"net/url"
 	"os"
+	"regexp"
 	"slices"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -36,47 +45,216 @@ func DiscardUntil(r io.Reader, bs ...byte) ([]byte, error) {
 	}
 }
 
-func DiscardMany(r io.Reader, n ...int) (int, error) {
-	size := -1
-	if len(n) > 0 && n[0] >= 0 {
-		size = n[0]
+// Network restricts network "tcp" or "udp" to the address family
+// selected by -4/-6, or leaves it as is to choose automatically.
+func Network(network string) string {
+	switch {
+	case Options.IPv4:
+		return network + "4"
+	case Options.IPv6:
+		return network + "6"
 	}
-	if size == 0 {
-		return 0, nil
+	return network
+}
+
+// Loopback returns the loopback ip of the selected address family.
+func Loopback() string {
+	if Options.IPv6 {
+		return "::1"
+	}
+	return "127.0.0.1"
+}
+
+// NCFamily returns the address family option of remote nc commands.
+func NCFamily() string {
+	switch {
+	case Options.IPv4:
+		return "-4 "
+	case Options.IPv6:
+		return "-6 "
 	}
-	if size < 0 {
-		size = 1024 * 1024
+	return ""
+}
+
+// NCOptions returns the common options of remote nc commands:
+// the address family and the connect timeout.
+func NCOptions() string {
+	return fmt.Sprintf("%v-w %v", NCFamily(), Options.Wait)
+}
+
+// ListenAddr returns the local listen address,
+// a bare port means listening on the loopback.
+func ListenAddr(listen string) string {
+	if !strings.Contains(listen, ":") {
+		return net.JoinHostPort(Loopback(), listen)
+	}
+	return listen
+}
+
+// Listen listens on local tcp address, or unix socket "unix:/path/to/socket",
+// the stale socket file left by a killed snc is removed first.
+func Listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen(Network("tcp"), addr)
 	}
-	discard := make([]byte, size)
-	discarded, err := r.Read(discard)
-	if discarded > 0 {
-		if Options.Debug {
-			os.Stdout.Write(discard[:discarded])
+	if fi, err := os.Lstat(path); err == nil && fi.Mode().Type() == fs.ModeSocket {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("unix socket %q is in use", path)
 		}
+		os.Remove(path)
 	}
-	return discarded, err
+	return net.Listen("unix", path)
 }
 
-func ParseConnectHostError(r io.Reader) error {
-	output, err := DiscardUntil(r, '$', '>')
-	if err != nil {
+// validHostname is a dns name, not an option of the remote nc.
+var validHostname = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_.-]*[A-Za-z0-9_.])?$`)
+
+// CheckDialHost checks the host to connect from remote, which comes from
+// socks or http clients: an ip or a hostname.
+func CheckDialHost(host string) error {
+	if net.ParseIP(host) != nil || validHostname.MatchString(host) {
+		return nil
+	}
+	return fmt.Errorf("invalid host %q", host)
+}
+
+// CheckDialAddr checks host as CheckDialHost, and port is a number.
+func CheckDialAddr(host, port string) error {
+	if err := CheckDialHost(host); err != nil {
 		return err
 	}
-	if bytes.HasSuffix(output, []byte{'$'}) {
-		return nil
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port %q", port)
 	}
-	lines := bytes.Split(output, []byte{'\n'})
-	return errors.New(string(bytes.Join(lines[:len(lines)-1], []byte{'\n'})))
+	return nil
 }
 
-func AllocProxy() (conn net.Conn, host, port string, err error) {
-	host, port, err = net.SplitHostPort(Options.Proxy)
+// SplitHostPort is like net.SplitHostPort, but the port is optional,
+// and a bare ipv6 address with or without brackets is accepted.
+func SplitHostPort(addr, dftPort string) (host, port string) {
+	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "split proxy host port %q: %v\n", Options.Proxy, err)
+		host, port = addr, ""
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		}
+	}
+	if port == "" {
+		port = dftPort
+	}
+	return
+}
+
+// SplitRemote splits remote file spec "host:path" or "[ipv6]:path".
+func SplitRemote(remote string) (host, path string) {
+	if strings.HasPrefix(remote, "[") {
+		if idx := strings.Index(remote, "]:"); idx >= 0 {
+			return remote[1:idx], remote[idx+2:]
+		}
+	}
+	host, path, _ = strings.Cut(remote, ":")
+	return
+}
+
+// proxyTLSConfig verifies sncd by the ca and/or the certificate
+// fingerprint pinned in config, or by system roots if neither.
+func proxyTLSConfig(host string) (*tls.Config, error) {
+	c := Conf.TLS
+	config := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+	if c.ServerName != "" {
+		config.ServerName = c.ServerName
+	}
+
+	if c.CA != "" {
+		pem, err := os.ReadFile(Conf.Path(c.CA))
+		if err != nil {
+			return nil, fmt.Errorf("read proxy ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in proxy ca %q", c.CA)
+		}
+		config.RootCAs = pool
+	}
+
+	if c.Cert != "" || c.Key != "" {
+		pair, err := tls.LoadX509KeyPair(Conf.Path(c.Cert), Conf.Path(c.Key))
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+
+	if c.Fingerprint != "" {
+		pin, err := hex.DecodeString(strings.ReplaceAll(c.Fingerprint, ":", ""))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid proxy fingerprint %q: want sha256 in hex", c.Fingerprint)
+		}
+		// the pinned certificate is trusted even if self-signed,
+		// but the chain is still verified if a ca is given.
+		config.InsecureSkipVerify = c.CA == ""
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("proxy presents no certificate")
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			if !bytes.Equal(sum[:], pin) {
+				return fmt.Errorf("proxy certificate fingerprint %X mismatch with pinned", sum)
+			}
+			return nil
+		}
+	}
+	return config, nil
+}
+
+// dialProxy connects to sncd, directly by "host:port", over tls by "tls://host:port",
+// or over websocket by "ws://host/path" or "wss://host/path".
+// The returned host is what the remote nc connects to.
+func dialProxy() (conn net.Conn, host string, err error) {
+	timeout := time.Duration(Options.Wait) * time.Second
+	if !strings.Contains(Options.Proxy, "://") {
+		host, _, err = net.SplitHostPort(Options.Proxy)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "split proxy host port %q: %v\n", Options.Proxy, err)
+			return
+		}
+		conn, err = Dial(Options.Proxy)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
 		return
 	}
 
-	conn, err = net.DialTimeout("tcp4", Options.Proxy, time.Duration(Options.Wait)*time.Second)
+	u, err := url.Parse(Options.Proxy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "parse proxy url %q: %v\n", Options.Proxy, err)
+		return
+	}
+	var dftPort string
+	switch u.Scheme {
+	case "tls":
+		dftPort = "65533"
+	case "ws":
+		dftPort = "80"
+	case "wss":
+		dftPort = "443"
+	default:
+		err = fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	host = u.Hostname()
+	port := u.Port()
+	if port == "" {
+		port = dftPort
+	}
+
+	conn, err = Dial(net.JoinHostPort(host, port))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		return
@@ -87,6 +265,47 @@ func AllocProxy() (conn net.Conn, host, port string, err error) {
 		}
 	}()
 
+	if u.Scheme == "tls" || u.Scheme == "wss" {
+		var config *tls.Config
+		config, err = proxyTLSConfig(host)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		tc := tls.Client(conn, config)
+		tc.SetDeadline(time.Now().Add(timeout))
+		err = tc.Handshake()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "tls handshake with proxy %q: %v\n", u.Host, err)
+			return
+		}
+		tc.SetDeadline(time.Time{})
+		conn = tc
+	}
+	if u.Scheme == "tls" {
+		return
+	}
+
+	ws, err := DialWebSocket(conn, u, timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	conn = ws
+	return
+}
+
+func AllocProxy() (conn net.Conn, host, port string, err error) {
+	conn, host, err = dialProxy()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+
 	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
 	debug := Options.Debug
 	Options.Debug = false
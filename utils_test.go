@@ -0,0 +1,89 @@
+package main
+
+import "testing"
+
+func TestCheckDialHost(t *testing.T) {
+	tests := []struct {
+		host string
+		ok   bool
+	}{
+		{"example.com", true},
+		{"db_1.internal.", true},
+		{"10.0.0.1", true},
+		{"fd00::20", true},
+		{"localhost", true},
+		{"-e/bin/sh", false},
+		{"-oProxyCommand=x", false},
+		{"a b", false},
+		{"a;id", false},
+		{"$(id)", false},
+		{"a-", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if err := CheckDialHost(tt.host); (err == nil) != tt.ok {
+			t.Errorf("CheckDialHost(%q) = %v, want ok %v", tt.host, err, tt.ok)
+		}
+	}
+}
+
+func TestCheckDialAddr(t *testing.T) {
+	tests := []struct {
+		host, port string
+		ok         bool
+	}{
+		{"example.com", "443", true},
+		{"fd00::20", "80", true},
+		{"example.com", "-e", false},
+		{"example.com", "80;id", false},
+		{"example.com", "65536", false},
+		{"-e/bin/sh", "80", false},
+	}
+	for _, tt := range tests {
+		if err := CheckDialAddr(tt.host, tt.port); (err == nil) != tt.ok {
+			t.Errorf("CheckDialAddr(%q, %q) = %v, want ok %v", tt.host, tt.port, err, tt.ok)
+		}
+	}
+}
+
+func TestSplitHostPort(t *testing.T) {
+	tests := []struct {
+		addr, host, port string
+	}{
+		{"example.com", "example.com", "22"},
+		{"example.com:2222", "example.com", "2222"},
+		{"example.com:", "example.com", "22"},
+		{"10.0.0.1:2222", "10.0.0.1", "2222"},
+		{"[fd00::1]:2222", "fd00::1", "2222"},
+		{"[fd00::1]", "fd00::1", "22"},
+		{"fd00::1", "fd00::1", "22"},
+	}
+	for _, tt := range tests {
+		if host, port := SplitHostPort(tt.addr, "22"); host != tt.host || port != tt.port {
+			t.Errorf("SplitHostPort(%q) = %q, %q, want %q, %q", tt.addr, host, port, tt.host, tt.port)
+		}
+	}
+}
+
+func TestSplitRemote(t *testing.T) {
+	tests := []struct {
+		remote, host, path string
+	}{
+		{"web-01:/tmp/x", "web-01", "/tmp/x"},
+		{"web-01:~/x", "web-01", "~/x"},
+		{"web-01:", "web-01", ""},
+		{"web-01", "web-01", ""},
+		{"web-01@root:/tmp/x", "web-01@root", "/tmp/x"},
+		{"jump@ops/db-01@root:data/x", "jump@ops/db-01@root", "data/x"},
+		{"[fd00::1]:/tmp/x", "fd00::1", "/tmp/x"},
+		{"[fd00::1]:", "fd00::1", ""},
+		// colons in the path are kept
+		{"web-01:/tmp/a:b", "web-01", "/tmp/a:b"},
+		{"[fd00::1]:/tmp/a:b", "fd00::1", "/tmp/a:b"},
+	}
+	for _, tt := range tests {
+		if host, path := SplitRemote(tt.remote); host != tt.host || path != tt.path {
+			t.Errorf("SplitRemote(%q) = %q, %q, want %q, %q", tt.remote, host, path, tt.host, tt.path)
+		}
+	}
+}
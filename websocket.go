@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal RFC 6455 websocket, just enough to carry a byte stream in
+// binary frames. It is shared by snc and sncd, so it must not depend on Options.
+//
+// Frames from client are always masked, and the payload is still rc4
+// encrypted by the caller, so that "*2\r\n$4\r\n" never goes out in clear.
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+type WSConn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	client bool
+
+	rmu     sync.Mutex
+	remain  int64 // unread payload bytes of current frame
+	mask    [4]byte
+	masked  bool
+	maskPos int
+	eof     bool
+
+	wmu  sync.Mutex
+	sent bool // close frame sent
+}
+
+func wsAcceptKey(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// DialWebSocket does the client handshake over an established conn,
+// which may already be a tls conn for "wss://".
+func DialWebSocket(conn net.Conn, u *url.URL, timeout time.Duration) (*WSConn, error) {
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	path := u.RequestURI()
+	if path == "" {
+		path = "/"
+	}
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	_, err := fmt.Fprintf(conn, "GET %v HTTP/1.1\r\n"+
+		"Host: %v\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %v\r\n"+
+		"Sec-WebSocket-Version: 13\r\n"+
+		"\r\n", path, u.Host, key)
+	if err != nil {
+		return nil, fmt.Errorf("websocket write handshake: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	req := &http.Request{Method: http.MethodGet}
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("websocket read handshake: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket handshake: unexpected status %v", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		return nil, errors.New("websocket handshake: invalid Sec-WebSocket-Accept")
+	}
+
+	return &WSConn{conn: conn, br: br, client: true}, nil
+}
+
+// AcceptWebSocket upgrades an http request to websocket.
+func AcceptWebSocket(w http.ResponseWriter, r *http.Request) (*WSConn, error) {
+	if r.Method != http.MethodGet ||
+		!strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, "websocket required", http.StatusBadRequest)
+		return nil, errors.New("not a websocket request")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket unsupported", http.StatusInternalServerError)
+		return nil, errors.New("http response writer is not a hijacker")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("websocket hijack: %w", err)
+	}
+
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %v\r\n"+
+		"\r\n", wsAcceptKey(key))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("websocket write handshake: %w", err)
+	}
+
+	return &WSConn{conn: conn, br: rw.Reader}, nil
+}
+
+func (ws *WSConn) writeFrame(op byte, payload []byte) error {
+	var hdr [14]byte
+	hdr[0] = 0x80 | op // FIN
+	n := 2
+	switch l := len(payload); {
+	case l < 126:
+		hdr[1] = byte(l)
+	case l <= 0xFFFF:
+		hdr[1] = 126
+		binary.BigEndian.PutUint16(hdr[2:], uint16(l))
+		n += 2
+	default:
+		hdr[1] = 127
+		binary.BigEndian.PutUint64(hdr[2:], uint64(l))
+		n += 8
+	}
+
+	if !ws.client {
+		if _, err := ws.conn.Write(hdr[:n]); err != nil {
+			return err
+		}
+		_, err := ws.conn.Write(payload)
+		return err
+	}
+
+	hdr[1] |= 0x80
+	var mask [4]byte
+	rand.Read(mask[:])
+	copy(hdr[n:], mask[:])
+	n += 4
+	buf := make([]byte, n+len(payload))
+	copy(buf, hdr[:n])
+	for i, b := range payload {
+		buf[n+i] = b ^ mask[i%4]
+	}
+	_, err := ws.conn.Write(buf)
+	return err
+}
+
+func (ws *WSConn) Write(p []byte) (int, error) {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	if ws.sent {
+		return 0, net.ErrClosed
+	}
+	if err := ws.writeFrame(wsOpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+var errWSFrame = errors.New("websocket: invalid frame")
+
+// nextFrame reads frame headers until a data frame, replying pings on the way.
+func (ws *WSConn) nextFrame() error {
+	for {
+		var hdr [2]byte
+		if _, err := io.ReadFull(ws.br, hdr[:]); err != nil {
+			return err
+		}
+		op := hdr[0] & 0x0F
+		ws.masked = hdr[1]&0x80 != 0
+		length := int64(hdr[1] & 0x7F)
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(ws.br, ext[:]); err != nil {
+				return err
+			}
+			length = int64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(ws.br, ext[:]); err != nil {
+				return err
+			}
+			if ext[0]&0x80 != 0 {
+				return errWSFrame // the most significant bit must be 0
+			}
+			length = int64(binary.BigEndian.Uint64(ext[:]))
+		}
+		// control frames must not be fragmented, nor longer than 125 bytes
+		if op&0x08 != 0 && (hdr[0]&0x80 == 0 || length > 125) {
+			return errWSFrame
+		}
+		if ws.masked {
+			if _, err := io.ReadFull(ws.br, ws.mask[:]); err != nil {
+				return err
+			}
+		}
+		ws.maskPos = 0
+
+		switch op {
+		case wsOpContinuation, wsOpText, wsOpBinary:
+			ws.remain = length
+			if length > 0 {
+				return nil
+			}
+		case wsOpClose:
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(ws.br, payload); err != nil {
+				return err
+			}
+			ws.unmask(payload)
+			if len(payload) > 2 {
+				payload = payload[:2] // echo the status code only
+			}
+			ws.wmu.Lock()
+			if !ws.sent {
+				ws.sent = true
+				ws.writeFrame(wsOpClose, payload)
+			}
+			ws.wmu.Unlock()
+			ws.eof = true
+			return io.EOF
+		case wsOpPing:
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(ws.br, payload); err != nil {
+				return err
+			}
+			ws.unmask(payload)
+			ws.wmu.Lock()
+			if !ws.sent {
+				ws.writeFrame(wsOpPong, payload)
+			}
+			ws.wmu.Unlock()
+		default: // pong or unknown control frame
+			if _, err := io.CopyN(io.Discard, ws.br, length); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (ws *WSConn) unmask(p []byte) {
+	if !ws.masked {
+		return
+	}
+	for i := range p {
+		p[i] ^= ws.mask[ws.maskPos%4]
+		ws.maskPos++
+	}
+}
+
+func (ws *WSConn) Read(p []byte) (int, error) {
+	ws.rmu.Lock()
+	defer ws.rmu.Unlock()
+	if ws.eof {
+		return 0, io.EOF
+	}
+	if ws.remain == 0 {
+		if err := ws.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > ws.remain {
+		p = p[:ws.remain]
+	}
+	n, err := ws.br.Read(p)
+	ws.unmask(p[:n])
+	ws.remain -= int64(n)
+	return n, err
+}
+
+// CloseWrite sends the close frame, the peer reads io.EOF.
+func (ws *WSConn) CloseWrite() error {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	if ws.sent {
+		return nil
+	}
+	ws.sent = true
+	return ws.writeFrame(wsOpClose, []byte{0x03, 0xE8}) // 1000: normal closure
+}
+
+// CloseRead is a no-op, websocket has no way to tell the peer.
+func (ws *WSConn) CloseRead() error {
+	return nil
+}
+
+func (ws *WSConn) Close() error {
+	ws.CloseWrite()
+	return ws.conn.Close()
+}
+
+func (ws *WSConn) LocalAddr() net.Addr                { return ws.conn.LocalAddr() }
+func (ws *WSConn) RemoteAddr() net.Addr               { return ws.conn.RemoteAddr() }
+func (ws *WSConn) SetDeadline(t time.Time) error      { return ws.conn.SetDeadline(t) }
+func (ws *WSConn) SetReadDeadline(t time.Time) error  { return ws.conn.SetReadDeadline(t) }
+func (ws *WSConn) SetWriteDeadline(t time.Time) error { return ws.conn.SetWriteDeadline(t) }
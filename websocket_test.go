@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestWebSocketRoundTrip(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := AcceptWebSocket(w, r)
+		if err != nil {
+			t.Errorf("accept: %v", err)
+			return
+		}
+		defer ws.Close()
+		io.Copy(ws, ws)
+		ws.CloseWrite()
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL + "/ws")
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, err := DialWebSocket(conn, u, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// 7 bits, 16 bits and 64 bits payload lengths
+	for _, n := range []int{1, 125, 126, 300, 0xFFFF, 0x10000 + 7} {
+		data := bytes.Repeat([]byte{byte(n)}, n)
+		data[0] = 0x81 // not to be mistaken as a header
+		go ws.Write(data)
+		got := make([]byte, n)
+		if _, err := io.ReadFull(ws, got); err != nil {
+			t.Fatalf("read %v bytes: %v", n, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("echo of %v bytes differs", n)
+		}
+	}
+
+	ws.CloseWrite()
+	if rest, err := io.ReadAll(ws); err != nil || len(rest) > 0 {
+		t.Errorf("after close: %q, %v, want EOF", rest, err)
+	}
+}
+
+// readFrames returns a server side WSConn reading the raw frames.
+func readFrames(frames []byte) (*WSConn, net.Conn) {
+	c1, c2 := net.Pipe()
+	return &WSConn{conn: c1, br: bufio.NewReader(bytes.NewReader(frames))}, c2
+}
+
+func TestWebSocketInvalidFrame(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"64 bits length with the high bit", []byte{0x82, 0x7F, 0x80, 0, 0, 0, 0, 0, 0, 1}},
+		{"control frame over 125 bytes", append([]byte{0x89, 0x7E, 0x00, 0x7E}, make([]byte, 126)...)},
+		{"fragmented control frame", []byte{0x09, 0x00}},
+		{"close frame over 125 bytes", append([]byte{0x88, 0x7E, 0x00, 0x80}, make([]byte, 128)...)},
+	}
+	for _, tt := range tests {
+		ws, peer := readFrames(tt.frame)
+		_, err := ws.Read(make([]byte, 16))
+		if !errors.Is(err, errWSFrame) {
+			t.Errorf("%v: read error %v, want %v", tt.name, err, errWSFrame)
+		}
+		peer.Close()
+	}
+}
+
+func TestWebSocketCloseEcho(t *testing.T) {
+	// a masked close frame with status 1000, as from a client
+	mask := []byte{1, 2, 3, 4}
+	frame := append([]byte{0x88, 0x82}, mask...)
+	frame = append(frame, 0x03^mask[0], 0xE8^mask[1])
+	ws, peer := readFrames(frame)
+	defer peer.Close()
+
+	reply := make(chan []byte)
+	go func() {
+		buf := make([]byte, 4)
+		io.ReadFull(peer, buf)
+		reply <- buf
+	}()
+
+	if _, err := ws.Read(make([]byte, 16)); err != io.EOF {
+		t.Errorf("read close frame: %v, want EOF", err)
+	}
+	select {
+	case got := <-reply:
+		if want := []byte{0x88, 0x02, 0x03, 0xE8}; !bytes.Equal(got, want) {
+			t.Errorf("close reply %x, want %x", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no close reply")
+	}
+	if _, err := ws.Write([]byte("x")); err == nil {
+		t.Errorf("write after close succeeded")
+	}
+}